@@ -11,7 +11,9 @@ require (
 )
 
 require (
-	github.com/go-logr/logr v1.2.0 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	go.opentelemetry.io/otel v1.10.0 // indirect
+	go.opentelemetry.io/otel/trace v1.10.0 // indirect
 	golang.org/x/text v0.4.0 // indirect
 	k8s.io/klog/v2 v2.60.1 // indirect
 )
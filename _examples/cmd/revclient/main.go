@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/sys/unix"
@@ -26,6 +27,8 @@ var (
 	flagRevProxyCert string
 	flagCert         string
 	flagDialerID     string
+	flagTCPTargets   string
+	flagProxyProto   int
 )
 
 func init() {
@@ -34,6 +37,8 @@ func init() {
 	flag.StringVar(&flagDialerID, "dialer-id", "", "Specify the dialer id (default: hostname")
 	flag.StringVar(&flagRevProxyHost, "proxy-host", "", "Specify host to reverse proxy")
 	flag.StringVar(&flagRevProxyCert, "proxy-host-cert", "", "Specify cert file name for the host to reverse proxy")
+	flag.StringVar(&flagTCPTargets, "tcp-targets", "", "Specify a comma separated list of host:port the server can forward TCP connections to")
+	flag.IntVar(&flagProxyProto, "proxy-protocol", 0, "Specify the PROXY protocol version (1 or 2) sent to the TCP targets (default: disabled)")
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, "Usage: h2rev2client [options]\n\n")
@@ -127,7 +132,14 @@ func main() {
 		}
 	}
 
-	l, err := h2rev2.NewListener(client, flagURL, flagDialerID)
+	var opts []h2rev2.ListenerOption
+	if flagTCPTargets != "" {
+		opts = append(opts, h2rev2.WithTCPTargets(strings.Split(flagTCPTargets, ",")...))
+	}
+	if flagProxyProto != 0 {
+		opts = append(opts, h2rev2.WithProxyProtocol(flagProxyProto))
+	}
+	l, err := h2rev2.NewListener(client, flagURL, flagDialerID, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/sys/unix"
@@ -21,6 +22,8 @@ var (
 	flagKey      string
 	flagBasePath string
 	flagACMEPort string
+	flagConnect  bool
+	flagHost     string
 )
 
 func init() {
@@ -29,6 +32,8 @@ func init() {
 	flag.StringVar(&flagKey, "key", "", "Specify the server certificate key file")
 	flag.StringVar(&flagBasePath, "base-path", "/", "Specify the base-path the reverse dialer handler should use")
 	flag.StringVar(&flagACMEPort, "acme-port", "80", "Specify the port to listen for Let's encrypt challenge")
+	flag.StringVar(&flagHost, "host-suffix", "", "Route the requests to the hosts <id><suffix> to the reverse connections of the id")
+	flag.BoolVar(&flagConnect, "connect-proxy", false, "Allow the clients to use the server as an HTTP proxy to CONNECT to <port>.<id>.tunnel:443")
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, "Usage: h2rev2server [options]\n\n")
@@ -62,6 +67,8 @@ func main() {
 	}()
 
 	revPool := h2rev2.NewReversePool()
+	revPool.EnableConnectProxy = flagConnect
+	revPool.HostSuffix = flagHost
 	defer revPool.Close()
 
 	mux := http.NewServeMux()
@@ -70,8 +77,16 @@ func main() {
 	// Create a server on port 8000
 	// Exactly how you would run an HTTP/1.1 server
 	srv := &http.Server{
-		Addr:    "0.0.0.0:" + flagPort,
-		Handler: mux,
+		Addr: "0.0.0.0:" + flagPort,
+		// the CONNECT requests do not have a path, and the virtual hosts
+		// are routed with any path
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect || (flagHost != "" && strings.HasSuffix(strings.Split(r.Host, ":")[0], flagHost)) {
+				revPool.ServeHTTP(w, r)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}),
 	}
 	defer srv.Close()
 
@@ -0,0 +1,218 @@
+package h2rev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// DialerInfo describes a Dialer registered in the ReversePool.
+type DialerInfo struct {
+	ID          string    `json:"id"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	// data connections open
+	ActiveConns int `json:"activeConnections"`
+	// bytes read from and written to the data connections
+	RxBytes   int64          `json:"rxBytes"`
+	TxBytes   int64          `json:"txBytes"`
+	Listeners []ListenerInfo `json:"listeners,omitempty"`
+}
+
+// ListenerInfo describes the control connection of one of the Listeners
+// of a Dialer.
+type ListenerInfo struct {
+	Session         string    `json:"session,omitempty"`
+	RemoteAddr      string    `json:"remoteAddr"`
+	ConnectedAt     time.Time `json:"connectedAt"`
+	Agent           string    `json:"agent,omitempty"`
+	ProtocolVersion int       `json:"protocolVersion,omitempty"`
+	Capabilities    []string  `json:"capabilities,omitempty"`
+	ActiveConns     int       `json:"activeConnections"`
+	Draining        bool      `json:"draining,omitempty"`
+}
+
+// info returns the description of the Dialer.
+func (d *Dialer) info() DialerInfo {
+	info := DialerInfo{
+		ID:          d.id,
+		ConnectedAt: d.created,
+		RxBytes:     d.rxBytes.load(),
+		TxBytes:     d.txBytes.load(),
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info.ActiveConns = len(d.conns)
+	for _, s := range d.sessions {
+		info.Listeners = append(info.Listeners, ListenerInfo{
+			Session:         s.sid,
+			RemoteAddr:      s.remoteAddr,
+			ConnectedAt:     s.connected,
+			Agent:           s.agent,
+			ProtocolVersion: s.version,
+			Capabilities:    s.capabilities,
+			ActiveConns:     s.active,
+			Draining:        s.draining,
+		})
+	}
+	return info
+}
+
+// Dialers returns the description of the Dialers registered, sorted by id.
+func (rp *ReversePool) Dialers() []DialerInfo {
+	rp.mu.Lock()
+	dialers := make([]*Dialer, 0, len(rp.pool))
+	for _, d := range rp.pool {
+		dialers = append(dialers, d)
+	}
+	rp.mu.Unlock()
+
+	infos := make([]DialerInfo, 0, len(dialers))
+	for _, d := range dialers {
+		infos = append(infos, d.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// DisconnectDialer closes the Dialer of the id, its control and data
+// connections. The Listeners reconnect unless the id is blocked.
+// It returns false if there is no Dialer for the id.
+func (rp *ReversePool) DisconnectDialer(id string) bool {
+	return rp.disconnect(id, ReasonDisconnected)
+}
+
+func (rp *ReversePool) disconnect(id string, reason string) bool {
+	rp.mu.Lock()
+	d, ok := rp.pool[id]
+	if ok {
+		delete(rp.pool, id)
+		rp.metrics().dialerUnregistered()
+	}
+	rp.mu.Unlock()
+	if !ok {
+		return false
+	}
+	klog.V(2).Infof("disconnecting dialer %s", id)
+	d.closeWithReason(reason)
+	d.closeConns(reason)
+	return true
+}
+
+// BlockDialer disconnects the Dialer of the id and rejects the Listeners
+// with that id until UnblockDialer is called.
+func (rp *ReversePool) BlockDialer(id string) {
+	rp.mu.Lock()
+	rp.blocked[id] = true
+	rp.mu.Unlock()
+	rp.disconnect(id, ReasonBlocked)
+}
+
+// UnblockDialer allows the Listeners with the id to register again.
+func (rp *ReversePool) UnblockDialer(id string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	delete(rp.blocked, id)
+}
+
+// IsBlocked returns true if the id is blocked.
+func (rp *ReversePool) IsBlocked(id string) bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.blocked[id]
+}
+
+// BlockedDialers returns the ids blocked, sorted.
+func (rp *ReversePool) BlockedDialers() []string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	ids := make([]string, 0, len(rp.blocked))
+	for id := range rp.blocked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// AdminHandler returns an http.Handler to inspect and manage the Dialers of
+// the pool, the responses are JSON. It must be served on its own path,
+// not exposed to the Listeners or the clients:
+//
+//	mux.Handle("/admin/", http.StripPrefix("/admin", pool.AdminHandler()))
+//
+// The handler serves the paths:
+//
+//	GET    /dialers       list the Dialers
+//	GET    /dialers/{id}  details of the Dialer and its Listeners
+//	DELETE /dialers/{id}  disconnect the Dialer
+//	GET    /blocked       list the ids blocked
+//	PUT    /blocked/{id}  block the id, disconnecting its Dialer
+//	DELETE /blocked/{id}  unblock the id
+func (rp *ReversePool) AdminHandler() http.Handler {
+	return http.HandlerFunc(rp.serveAdmin)
+}
+
+func (rp *ReversePool) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) > 2 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	id := ""
+	if len(path) == 2 {
+		id = path[1]
+	}
+
+	switch path[0] {
+	case "dialers":
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, rp.Dialers())
+		case id != "" && r.Method == http.MethodGet:
+			d := rp.GetDialer(id)
+			if d == nil {
+				writeJSONError(w, http.StatusNotFound, "dialer not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, d.info())
+		case id != "" && r.Method == http.MethodDelete:
+			if !rp.DisconnectDialer(id) {
+				writeJSONError(w, http.StatusNotFound, "dialer not found")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case "blocked":
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, rp.BlockedDialers())
+		case id != "" && r.Method == http.MethodPut:
+			rp.BlockDialer(id)
+			w.WriteHeader(http.StatusNoContent)
+		case id != "" && r.Method == http.MethodDelete:
+			rp.UnblockDialer(id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.V(2).Infof("error writing admin response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
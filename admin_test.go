@@ -0,0 +1,107 @@
+package h2rev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, method string, uri string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminHandler(t *testing.T) {
+	pool := NewReversePool()
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", pool.AdminHandler()))
+	adminServer := httptest.NewServer(mux)
+	defer adminServer.Close()
+	admin := adminServer.URL + "/admin"
+
+	publicServer, l, stop := setupPool(t, pool, WithAgentVersion("agent/v1"))
+	defer stop()
+	defer serveSlow(l, "l1").Close()
+
+	if body, _, err := getBody(publicServer.Client(), publicServer.URL+"/proxy/d001/"); err != nil || body != "l1" {
+		t.Fatalf("unexpected response %q: %v", body, err)
+	}
+
+	var dialers []DialerInfo
+	if code := adminRequest(t, http.MethodGet, admin+"/dialers", &dialers); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(dialers) != 1 || dialers[0].ID != "d001" {
+		t.Fatalf("unexpected dialers %+v", dialers)
+	}
+	if dialers[0].RxBytes == 0 || dialers[0].TxBytes == 0 {
+		t.Errorf("expected bytes transferred, got %+v", dialers[0])
+	}
+
+	var info DialerInfo
+	if code := adminRequest(t, http.MethodGet, admin+"/dialers/d001", &info); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(info.Listeners) != 1 || info.Listeners[0].Agent != "agent/v1" || info.Listeners[0].RemoteAddr == "" || info.Listeners[0].ConnectedAt.IsZero() {
+		t.Errorf("unexpected dialer details %+v", info)
+	}
+	if code := adminRequest(t, http.MethodGet, admin+"/dialers/d002", nil); code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, code)
+	}
+
+	// the Listener reconnects after being disconnected
+	d := pool.GetDialer("d001")
+	if code := adminRequest(t, http.MethodDelete, admin+"/dialers/d001", nil); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dialer not closed")
+	}
+	waitHandshake(t, pool, "d001")
+
+	// blocked ids can not register again
+	if code := adminRequest(t, http.MethodPut, admin+"/blocked/d001", nil); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	var blocked []string
+	if code := adminRequest(t, http.MethodGet, admin+"/blocked", &blocked); code != http.StatusOK || len(blocked) != 1 || blocked[0] != "d001" {
+		t.Errorf("unexpected blocked ids %v status %d", blocked, code)
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Errorf("expected Listener closed")
+	}
+	if pool.GetDialer("d001") != nil {
+		t.Errorf("expected dialer d001 not registered")
+	}
+	if _, err := NewListener(publicServer.Client(), publicServer.URL, "d001"); err == nil {
+		t.Errorf("expected blocked Listener to fail")
+	}
+
+	if code := adminRequest(t, http.MethodDelete, admin+"/blocked/d001", nil); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	l2, err := NewListener(publicServer.Client(), publicServer.URL, "d001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.Close()
+}
@@ -0,0 +1,200 @@
+package h2rev2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Authenticator decides if the request registering reverse connections
+// for the id is allowed. Returning an error denies the request.
+type Authenticator interface {
+	Authenticate(r *http.Request, id string) error
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions
+// as Authenticators.
+type AuthenticatorFunc func(r *http.Request, id string) error
+
+// Authenticate calls f(r, id).
+func (f AuthenticatorFunc) Authenticate(r *http.Request, id string) error {
+	return f(r, id)
+}
+
+// ErrUnauthenticated is returned by the Authenticators when the request
+// does not carry valid credentials for the id.
+var ErrUnauthenticated = errors.New("revdial: unauthenticated")
+
+// TokenAuthenticator returns an Authenticator that requires an
+// Authorization Bearer header with the static token assigned to the id.
+func TokenAuthenticator(tokens map[string]string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request, id string) error {
+		want, ok := tokens[id]
+		if !ok {
+			return fmt.Errorf("%w: no token for id %s", ErrUnauthenticated, id)
+		}
+		if !tokenEqual(bearerToken(r), want) {
+			return fmt.Errorf("%w: invalid token for id %s", ErrUnauthenticated, id)
+		}
+		return nil
+	})
+}
+
+// HMACAuthenticator returns an Authenticator that requires an
+// Authorization Bearer header with the id signed with the key,
+// as generated by HMACToken.
+func HMACAuthenticator(key []byte) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request, id string) error {
+		if !tokenEqual(bearerToken(r), HMACToken(key, id)) {
+			return fmt.Errorf("%w: invalid signature for id %s", ErrUnauthenticated, id)
+		}
+		return nil
+	})
+}
+
+// HMACToken returns the hex encoded HMAC-SHA256 of the id using key.
+func HMACToken(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ClientCertAuthenticator returns an Authenticator that requires a verified
+// TLS client certificate whose Common Name or DNS Subject Alternative Names
+// match the id. The server must be configured to verify client certificates.
+func ClientCertAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request, id string) error {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			return fmt.Errorf("%w: verified client certificate required", ErrUnauthenticated)
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		if cert.Subject.CommonName == id || strSliceContains(cert.DNSNames, id) {
+			return nil
+		}
+		return fmt.Errorf("%w: client certificate does not match id %s", ErrUnauthenticated, id)
+	})
+}
+
+// bearerToken returns the token on the Authorization header of the request,
+// or on the Proxy-Authorization header of the CONNECT requests to the proxy.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if isProxyConnect(r) {
+		auth = r.Header.Get("Proxy-Authorization")
+	}
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return auth[len(prefix):]
+}
+
+// tokenEqual compares the tokens in constant time.
+func tokenEqual(got, want string) bool {
+	if got == "" || want == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Authorizer decides if the request can be proxied through the reverse
+// connections of the id. If the request is denied, the status code is
+// returned to the client, http.StatusForbidden is used if it is zero.
+type Authorizer interface {
+	Authorize(r *http.Request, id string) (allow bool, status int)
+}
+
+// AuthorizerFunc is an adapter to allow the use of ordinary functions
+// as Authorizers.
+type AuthorizerFunc func(r *http.Request, id string) (bool, int)
+
+// Authorize calls f(r, id).
+func (f AuthorizerFunc) Authorize(r *http.Request, id string) (bool, int) {
+	return f(r, id)
+}
+
+// CredentialsAuthorizer is an Authorizer that consumes the credentials on
+// the request headers. The headers are removed from the requests once
+// authorized, so the credentials of the pool do not reach the Listeners.
+type CredentialsAuthorizer interface {
+	Authorizer
+	// CredentialHeaders returns the headers with the credentials.
+	CredentialHeaders() []string
+}
+
+// StripHeaders returns a CredentialsAuthorizer that authorizes the requests
+// with a and removes the headers from the requests authorized.
+func StripHeaders(a Authorizer, headers ...string) CredentialsAuthorizer {
+	return credentialsAuthorizer{Authorizer: a, headers: headers}
+}
+
+type credentialsAuthorizer struct {
+	Authorizer
+	headers []string
+}
+
+// CredentialHeaders implements CredentialsAuthorizer.
+func (a credentialsAuthorizer) CredentialHeaders() []string {
+	return a.headers
+}
+
+// removeCredentials removes the headers with the credentials consumed by the
+// Authorizer from the request authorized.
+func removeCredentials(a Authorizer, r *http.Request) {
+	ca, ok := a.(CredentialsAuthorizer)
+	if !ok {
+		return
+	}
+	for _, h := range ca.CredentialHeaders() {
+		r.Header.Del(h)
+	}
+}
+
+// TokenAuthorizer returns an Authorizer that requires an Authorization
+// Bearer header with one of the tokens, each token is scoped to a set of ids.
+// Requests without a valid token get a 401, and requests with a token not
+// scoped to the id a 403. The CONNECT requests to the proxy carry the token
+// on the Proxy-Authorization header and get a 407 instead of a 401.
+// The token is removed from the requests proxied, so it does not reach the
+// Listener.
+func TokenAuthorizer(scopes map[string][]string) Authorizer {
+	return StripHeaders(AuthorizerFunc(func(r *http.Request, id string) (bool, int) {
+		token := bearerToken(r)
+		for t, ids := range scopes {
+			if !tokenEqual(token, t) {
+				continue
+			}
+			if strSliceContains(ids, id) {
+				return true, http.StatusOK
+			}
+			return false, http.StatusForbidden
+		}
+		return false, http.StatusUnauthorized
+	}), "Authorization", "Proxy-Authorization")
+}
+
+// ClientCertAuthorizer returns an Authorizer that requires a verified TLS
+// client certificate, the Common Name or DNS Subject Alternative Names of the
+// certificate are matched against the subjects, each scoped to a set of ids.
+// Requests without a verified certificate get a 401, and requests with a
+// certificate not scoped to the id a 403.
+func ClientCertAuthorizer(scopes map[string][]string) Authorizer {
+	return AuthorizerFunc(func(r *http.Request, id string) (bool, int) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			return false, http.StatusUnauthorized
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		subjects := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+		for _, s := range subjects {
+			if strSliceContains(scopes[s], id) {
+				return true, http.StatusOK
+			}
+		}
+		return false, http.StatusForbidden
+	})
+}
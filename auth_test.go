@@ -0,0 +1,392 @@
+package h2rev2
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthenticators(t *testing.T) {
+	key := []byte("secret")
+	certReq := func(cn string, dnsNames ...string) *http.Request {
+		r := httptest.NewRequest("GET", "/revdial?id=d001", nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+		return r
+	}
+	tokenReq := func(token string) *http.Request {
+		r := httptest.NewRequest("GET", "/revdial?id=d001", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+	tests := []struct {
+		name    string
+		auth    Authenticator
+		req     *http.Request
+		id      string
+		wantErr bool
+	}{
+		{
+			name: "valid token",
+			auth: TokenAuthenticator(map[string]string{"d001": "token1"}),
+			req:  tokenReq("token1"),
+			id:   "d001",
+		},
+		{
+			name:    "token for other id",
+			auth:    TokenAuthenticator(map[string]string{"d001": "token1", "d002": "token2"}),
+			req:     tokenReq("token2"),
+			id:      "d001",
+			wantErr: true,
+		},
+		{
+			name:    "missing token",
+			auth:    TokenAuthenticator(map[string]string{"d001": "token1"}),
+			req:     tokenReq(""),
+			id:      "d001",
+			wantErr: true,
+		},
+		{
+			name:    "unknown id",
+			auth:    TokenAuthenticator(map[string]string{"d001": "token1"}),
+			req:     tokenReq("token1"),
+			id:      "d002",
+			wantErr: true,
+		},
+		{
+			name: "valid hmac",
+			auth: HMACAuthenticator(key),
+			req:  tokenReq(HMACToken(key, "d001")),
+			id:   "d001",
+		},
+		{
+			name:    "hmac for other id",
+			auth:    HMACAuthenticator(key),
+			req:     tokenReq(HMACToken(key, "d002")),
+			id:      "d001",
+			wantErr: true,
+		},
+		{
+			name:    "hmac other key",
+			auth:    HMACAuthenticator(key),
+			req:     tokenReq(HMACToken([]byte("other"), "d001")),
+			id:      "d001",
+			wantErr: true,
+		},
+		{
+			name: "client cert common name",
+			auth: ClientCertAuthenticator(),
+			req:  certReq("d001"),
+			id:   "d001",
+		},
+		{
+			name: "client cert SAN",
+			auth: ClientCertAuthenticator(),
+			req:  certReq("agent", "d002", "d001"),
+			id:   "d001",
+		},
+		{
+			name:    "client cert mismatch",
+			auth:    ClientCertAuthenticator(),
+			req:     certReq("d002", "d003"),
+			id:      "d001",
+			wantErr: true,
+		},
+		{
+			name:    "no client cert",
+			auth:    ClientCertAuthenticator(),
+			req:     tokenReq(""),
+			id:      "d001",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.auth.Authenticate(tt.req, tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_e2e_authenticator(t *testing.T) {
+	pool := NewReversePool()
+	pool.Authenticator = TokenAuthenticator(map[string]string{"d001": "token1"})
+	publicServer := httptest.NewUnstartedServer(pool)
+	publicServer.EnableHTTP2 = true
+	publicServer.StartTLS()
+	defer publicServer.Close()
+	defer pool.Close()
+
+	_, err := NewListener(publicServer.Client(), publicServer.URL, "d001", WithBearerToken("wrong"))
+	if err == nil || !isPermanentError(err) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+	if d := pool.GetDialer("d001"); d != nil {
+		t.Fatalf("unexpected dialer registered")
+	}
+
+	l, err := NewListener(publicServer.Client(), publicServer.URL, "d001", WithBearerToken("token1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	var d *Dialer
+	for i := 0; i < 5; i++ {
+		d = pool.GetDialer("d001")
+		if d != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if d == nil {
+		t.Fatal("dialer not registered")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := d.Dial(ctx, "", "")
+	if err != nil {
+		t.Fatalf("data connection with credentials failed: %v", err)
+	}
+	c.Close()
+}
+
+func TestAuthorizers(t *testing.T) {
+	certReq := func(cn string, dnsNames ...string) *http.Request {
+		r := httptest.NewRequest("GET", "/proxy/d001/", nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+		return r
+	}
+	tokenReq := func(token string) *http.Request {
+		r := httptest.NewRequest("GET", "/proxy/d001/", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+	tokens := TokenAuthorizer(map[string][]string{
+		"token1": {"d001", "d002"},
+		"token2": {"d003"},
+	})
+	certs := ClientCertAuthorizer(map[string][]string{
+		"client1":             {"d001"},
+		"client2.example.com": {"d002"},
+	})
+	tests := []struct {
+		name       string
+		authz      Authorizer
+		req        *http.Request
+		id         string
+		wantAllow  bool
+		wantStatus int
+	}{
+		{
+			name:       "token scoped to id",
+			authz:      tokens,
+			req:        tokenReq("token1"),
+			id:         "d002",
+			wantAllow:  true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "token not scoped to id",
+			authz:      tokens,
+			req:        tokenReq("token2"),
+			id:         "d001",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "unknown token",
+			authz:      tokens,
+			req:        tokenReq("token3"),
+			id:         "d001",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing token",
+			authz:      tokens,
+			req:        tokenReq(""),
+			id:         "d001",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "client cert common name",
+			authz:      certs,
+			req:        certReq("client1"),
+			id:         "d001",
+			wantAllow:  true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "client cert SAN",
+			authz:      certs,
+			req:        certReq("other", "client2.example.com"),
+			id:         "d002",
+			wantAllow:  true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "client cert not scoped to id",
+			authz:      certs,
+			req:        certReq("client1"),
+			id:         "d002",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "no client cert",
+			authz:      certs,
+			req:        tokenReq("token1"),
+			id:         "d001",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, status := tt.authz.Authorize(tt.req, tt.id)
+			if allow != tt.wantAllow || status != tt.wantStatus {
+				t.Errorf("Authorize() = %v, %d, want %v, %d", allow, status, tt.wantAllow, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestReversePoolAuthorizer(t *testing.T) {
+	pool := NewReversePool()
+	pool.Authorizer = TokenAuthorizer(map[string][]string{"token1": {"d001"}})
+	defer pool.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+	}{
+		{
+			name:       "no token",
+			path:       "/proxy/d001/",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "token not scoped to id",
+			path:       "/proxy/d002/",
+			token:      "token1",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			// authorized but there are no reverse connections
+			name:       "authorized",
+			path:       "/proxy/d001/",
+			token:      "token1",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			pool.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_e2e_authorizer_credentials(t *testing.T) {
+	apiKey := AuthorizerFunc(func(r *http.Request, id string) (bool, int) {
+		return r.Header.Get("X-Api-Key") == "key1", http.StatusUnauthorized
+	})
+	tests := []struct {
+		name       string
+		authorizer Authorizer
+		stripped   []string
+		forwarded  []string
+	}{
+		{
+			name:       "token",
+			authorizer: TokenAuthorizer(map[string][]string{"token1": {"d001"}}),
+			stripped:   []string{"Authorization", "Proxy-Authorization"},
+			forwarded:  []string{"X-Api-Key"},
+		},
+		{
+			name:       "custom",
+			authorizer: StripHeaders(apiKey, "X-Api-Key"),
+			stripped:   []string{"X-Api-Key"},
+			forwarded:  []string{"Authorization"},
+		},
+		{
+			// the Authorizers do not remove the headers unless they
+			// declare them
+			name:       "custom not stripped",
+			authorizer: apiKey,
+			forwarded:  []string{"X-Api-Key", "Authorization"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewReversePool()
+			pool.Authorizer = tt.authorizer
+			publicServer, l, stop := setupPool(t, pool)
+			defer stop()
+
+			headers := make(chan http.Header, 1)
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers <- r.Header.Clone()
+			})}
+			defer server.Close()
+			go server.Serve(l)
+
+			req, err := http.NewRequest("GET", publicServer.URL+"/proxy/d001/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer token1")
+			req.Header.Set("Proxy-Authorization", "Bearer token1")
+			req.Header.Set("X-Api-Key", "key1")
+			resp, err := publicServer.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			got := <-headers
+			for _, h := range tt.stripped {
+				if v := got.Get(h); v != "" {
+					t.Errorf("backend received the %s header %q", h, v)
+				}
+			}
+			for _, h := range tt.forwarded {
+				if got.Get(h) == "" {
+					t.Errorf("backend did not receive the %s header: %v", h, got)
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package h2rev2
 
 import (
+	"errors"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,41 +19,194 @@ type conn struct {
 	rc   io.ReadCloser
 	wc   io.WriteCloser
 
-	rx chan []byte // channel to read asynchronous
-
-	once  sync.Once   // Protects closing the connection
-	timer *time.Timer // delays closing the connection too fast (give time to the writer to flush)
+	rx   chan *[]byte // chunks read asynchronous, the buffers come from readBufPool
+	rbuf *[]byte      // chunk being read, guarded by rdMu
+	rpos int          // bytes of rbuf already read
+
+	// half-close of the reads, reof is closed once the peer ends its writes
+	// and rshut once CloseRead is called, the peer may end its writes at
+	// rlimit bytes without ending the stream
+	rmu    sync.Mutex // guards below
+	rcount int64      // bytes read
+	rlimit int64      // end of the data of the peer, if not negative
+	reof   chan struct{}
+	rshut  chan struct{}
+
+	// the data written is buffered on wbuf and written asynchronous on wc,
+	// so the writes can be cancelled knowing the bytes accepted
+	wmu    sync.Mutex    // guards wbuf and werr
+	wbuf   []byte        // data buffered, up to writeBufSize
+	werr   error         // error writing on wc
+	wready chan struct{} // signals there is data buffered
+	wshut  chan struct{} // closed by CloseWrite to write the data buffered and end the writes
+	wspace chan struct{} // signals there is room on the buffer
+	wclose chan struct{} // closed to write the data buffered and stop writing
+	wdone  chan struct{} // closed once the asynchronous writer returns
+	// closed once the data written on wc is sent to the peer after closing
+	// wc, if closing wc does not wait for it, guarded by wmu
+	wsent <-chan struct{}
+
+	once  sync.Once // Protects closing the connection
 	done  chan struct{}
+	ended chan struct{} // closed once the stream is ended or aborted after Close
+	// linger of the data buffered on Close as in SetLinger, guarded by wmu.
+	// aborted is set if the stream is aborted, before ended is closed.
+	linger  time.Duration
+	aborted bool
 
 	readDeadline  *connDeadline
 	writeDeadline *connDeadline
+
+	// metadata of the connection on the Listener side
+	meta Metadata
+	// addresses of the connection, if known
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	// optional counters of the bytes read, guarded by rmu, and written,
+	// guarded by wrMu
+	rxCounters []Counter
+	txCounters []Counter
+
+	// identifies the data connection on both sides, if the pool sent it
+	id string
+	// reason the connection was closed, sent to the peer if sendReason is
+	// set, and received from it with peerReason. If closePeer is set, the
+	// peer is asked to close the connection with the reason instead.
+	headerMu   sync.Mutex // guards the response headers of the connection
+	peerMu     sync.Mutex // guards reason and the functions below
+	reason     string
+	sendReason func(reason string)
+	peerReason func() string
+	closePeer  func(reason string) bool
+	// closeWrite ends the writes of the stream after the bytes sent, if
+	// not set the connection does not support half-close. peerDone is
+	// closed once the peer closes the stream, if it can end its writes
+	// without closing it.
+	closeWrite func(sent int64) error
+	peerDone   <-chan struct{}
+
+	// optional idle timeout and max lifetime
+	idleTimeout time.Duration
+	lastActive  int64      // unix nanoseconds, atomic
+	timerMu     sync.Mutex // guards below, Close may run before the timers are set
+	idleTimer   *time.Timer
+	lifeTimer   *time.Timer
+	timersDone  bool // the timers are stopped and can not be set
+}
+
+// byteCount is a Counter that can be read
+type byteCount int64
+
+func (b *byteCount) Add(v float64) {
+	atomic.AddInt64((*int64)(b), int64(v))
+}
+
+func (b *byteCount) load() int64 {
+	return atomic.LoadInt64((*int64)(b))
 }
 
+// time to wait for the peer to close the connection when asked to
+const closePeerTimeout = time.Second
+
+// time to wait for the data buffered to be written in the background before
+// aborting the stream, with the default linger
+const defaultLingerTimeout = 30 * time.Second
+
+// size of the buffer of the writes, Write blocks once it is full until the
+// peer reads the data
+const writeBufSize = 32 * 1024
+
+// errHalfCloseNotSupported is returned by CloseWrite if the peer can not
+// end the reads of the connection
+var errHalfCloseNotSupported = errors.New("h2rev2: half-close not supported by the peer")
+
+// errWriteAborted is returned to the peer when the data buffered can not be
+// written on close
+var errWriteAborted = errors.New("h2rev2: connection writes aborted")
+
 func newConn(rc io.ReadCloser, wc io.WriteCloser) *conn {
 	c := &conn{
 		rc: rc,
 		wc: wc,
-		rx: make(chan []byte),
+		rx: make(chan *[]byte),
+
+		rlimit: -1,
+		reof:   make(chan struct{}),
+		rshut:  make(chan struct{}),
+
+		wready: make(chan struct{}, 1),
+		wshut:  make(chan struct{}),
+		wspace: make(chan struct{}, 1),
+		wclose: make(chan struct{}),
+		wdone:  make(chan struct{}),
 
 		done:          make(chan struct{}),
+		ended:         make(chan struct{}),
+		linger:        -1,
 		readDeadline:  makeConnDeadline(),
 		writeDeadline: makeConnDeadline(),
 	}
 	go c.asyncRead()
+	go c.asyncWrite()
 	return c
 }
 
+// size of the buffers of the reads, the default maximum size of the
+// HTTP/2 frames is 16KB
+const readBufSize = 32 * 1024
+
+// readBufPool reuses the buffers of the chunks read, Read returns them once
+// they are fully consumed.
+var readBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, readBufSize)
+		return &b
+	},
+}
+
+func getReadBuf() *[]byte {
+	b := readBufPool.Get().(*[]byte)
+	*b = (*b)[:cap(*b)]
+	return b
+}
+
 // async reader to avoid cancelling reads
 func (c *conn) asyncRead() {
-	buf := make([]byte, 1024)
 	for {
-		n, err := c.rc.Read(buf)
+		b := getReadBuf()
+		n, err := c.rc.Read(*b)
 		if n > 0 {
-			tmp := make([]byte, n)
-			copy(tmp, buf[:n])
-			c.rx <- tmp
+			*b = (*b)[:n]
+			// the data is discarded after CloseRead or Close
+			select {
+			case c.rx <- b:
+				// accounted once handed to Read, before the end of the
+				// stream can close the connection
+				c.countRead(n)
+			case <-c.rshut:
+				readBufPool.Put(b)
+			case <-c.done:
+				readBufPool.Put(b)
+			}
+			c.received(int64(n))
+		} else {
+			readBufPool.Put(b)
 		}
 		if err != nil {
+			if err == io.EOF {
+				// the peer tells why it closed the connection
+				c.receiveReason()
+				// or it only ended its writes, and it can read until it
+				// closes the stream
+				if peerDone := c.peerDoneChan(); peerDone != nil {
+					c.endRead(0)
+					select {
+					case <-peerDone:
+					case <-c.done:
+					}
+				}
+			}
 			c.Close()
 			return
 		}
@@ -131,36 +287,116 @@ func isClosedChan(c <-chan struct{}) bool {
 	}
 }
 
-// Write writes data to the connection
+// asyncWrite writes the data buffered by Write until the connection is
+// closed, then it writes the data left and returns.
+func (c *conn) asyncWrite() {
+	defer close(c.wdone)
+	var out []byte
+	var sent int64
+	for {
+		closing, shut := false, false
+		select {
+		case <-c.wready:
+		case <-c.wclose:
+			closing = true
+		case <-c.wshut:
+			closing, shut = true, true
+		}
+		// swap the buffers, so Write can continue while this one is written
+		c.wmu.Lock()
+		out, c.wbuf = c.wbuf, out[:0]
+		c.wmu.Unlock()
+		select {
+		case c.wspace <- struct{}{}:
+		default:
+		}
+		if len(out) > 0 {
+			n, err := c.wc.Write(out)
+			sent += int64(n)
+			if err != nil {
+				c.wmu.Lock()
+				c.werr = err
+				c.wmu.Unlock()
+				return
+			}
+		}
+		if shut {
+			if err := c.getCloseWrite()(sent); err != nil {
+				c.wmu.Lock()
+				c.werr = err
+				c.wmu.Unlock()
+			}
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+// Write writes data to the connection, it returns once the data is
+// buffered to be sent. If the deadline expires or the connection is closed
+// it returns the number of bytes buffered, they only reach the peer if
+// Close lingers long enough to send them, the buffer is discarded after
+// SetLinger(0), the linger timeout or a write error.
 func (c *conn) Write(data []byte) (int, error) {
-	writeDone := make(chan struct{})
+	c.wrMu.Lock()
+	defer c.wrMu.Unlock()
+
 	var n int
 	var err error
-	go func() {
-		c.wrMu.Lock()
-		defer c.wrMu.Unlock()
-
-		defer close(writeDone)
+	for {
 		switch {
-		case isClosedChan(c.done):
-			return
+		case isClosedChan(c.done), isClosedChan(c.wshut):
+			err = io.ErrClosedPipe
 		case isClosedChan(c.writeDeadline.wait()):
-			return
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			break
 		}
-		n, err = c.wc.Write(data)
-		if err == nil {
-			c.timer = time.NewTimer(time.Second)
+		c.wmu.Lock()
+		m := 0
+		if c.werr != nil {
+			err = c.werr
+		} else if isClosedChan(c.wclose) || isClosedChan(c.wshut) {
+			// the writer does not take more data once it ends
+			err = io.ErrClosedPipe
+		} else {
+			if c.wbuf == nil {
+				c.wbuf = make([]byte, 0, writeBufSize)
+			}
+			m = len(data) - n
+			if free := cap(c.wbuf) - len(c.wbuf); m > free {
+				m = free
+			}
+			c.wbuf = append(c.wbuf, data[n:n+m]...)
+			n += m
+		}
+		c.wmu.Unlock()
+		if m > 0 {
+			select {
+			case c.wready <- struct{}{}:
+			default:
+			}
+		}
+		if err != nil || n == len(data) {
+			break
+		}
+		// wait for the buffer to be written
+		select {
+		case <-c.wspace:
+		case <-c.wdone:
+		case <-c.done:
+		case <-c.writeDeadline.wait():
 		}
-	}()
-
-	select {
-	case <-c.done:
-		return 0, io.ErrClosedPipe
-	case <-c.writeDeadline.wait():
-		return 0, os.ErrDeadlineExceeded
-	case <-writeDone:
 	}
 
+	if n > 0 {
+		c.active()
+		for _, counter := range c.txCounters {
+			counter.Add(float64(n))
+		}
+	}
 	return n, err
 }
 
@@ -169,35 +405,231 @@ func (c *conn) Read(data []byte) (int, error) {
 	c.rdMu.Lock()
 	defer c.rdMu.Unlock()
 
-	select {
-	case <-c.done:
-		// TODO: TestConn/BasicIO the other end stops writing and the http connection is closed
-		// closing this connection that is blocked on read.
+	if isClosedChan(c.rshut) {
+		if c.rbuf != nil {
+			readBufPool.Put(c.rbuf)
+			c.rbuf = nil
+		}
 		return 0, io.EOF
-	case <-c.readDeadline.wait():
-		return 0, os.ErrDeadlineExceeded
-	case d, ok := <-c.rx:
-		if !ok {
+	}
+	// the bytes left of the last chunk are read first, even if the
+	// connection is closed
+	if c.rbuf == nil {
+		select {
+		case <-c.done:
+			// TODO: TestConn/BasicIO the other end stops writing and the http connection is closed
+			// closing this connection that is blocked on read.
+			return 0, io.EOF
+		case <-c.reof:
+			return 0, io.EOF
+		case <-c.rshut:
 			return 0, io.EOF
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case b := <-c.rx:
+			c.rbuf = b
+			c.rpos = 0
 		}
-		copy(data, d)
-		return len(d), nil
+	} else if isClosedChan(c.readDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n := copy(data, (*c.rbuf)[c.rpos:])
+	c.rpos += n
+	if c.rpos == len(*c.rbuf) {
+		readBufPool.Put(c.rbuf)
+		c.rbuf = nil
 	}
+	c.active()
+	return n, nil
 }
 
-// Close closes the connection
+// Close closes the connection, the reads and writes in progress are
+// unblocked and return errors. The data buffered is written and then the
+// stream is ended, unless SetLinger says otherwise.
 func (c *conn) Close() error {
 	c.once.Do(c.close)
 	return nil
 }
 
 func (c *conn) close() {
-	if c.timer != nil {
-		<-c.timer.C
+	c.stopTimers()
+	close(c.done)
+	// write the data buffered before ending the stream
+	c.wmu.Lock()
+	close(c.wclose)
+	linger := c.linger
+	c.wmu.Unlock()
+	if linger < 0 {
+		go c.end(defaultLingerTimeout)
+		return
+	}
+	c.end(linger)
+}
+
+// end ends the stream once the data buffered is written, or aborts it if
+// it is not written during the linger.
+func (c *conn) end(linger time.Duration) {
+	var expired <-chan time.Time
+	if linger > 0 {
+		t := time.NewTimer(linger)
+		defer t.Stop()
+		expired = t.C
+	}
+	if linger != 0 {
+		select {
+		case <-c.wdone:
+		case <-expired:
+		}
+	}
+	if isClosedChan(c.wdone) {
+		c.sendCloseReason()
+		c.wc.Close()
+		c.wmu.Lock()
+		wsent := c.wsent
+		c.wmu.Unlock()
+		if wsent != nil && linger != 0 {
+			select {
+			case <-wsent:
+			case <-expired:
+				c.aborted = true
+			}
+		}
+	} else {
+		c.aborted = true
+		if a, ok := c.wc.(interface{ CloseWithError(error) error }); ok {
+			// the peer does not read, abort the write in progress
+			a.CloseWithError(errWriteAborted)
+			<-c.wdone
+		}
+		c.wc.Close()
 	}
 	c.rc.Close()
-	c.wc.Close()
-	close(c.done)
+	close(c.ended)
+}
+
+// SetLinger sets the behavior of Close when the connection still has data
+// waiting to be written, as in net.TCPConn.
+//
+// If sec < 0 (the default), Close returns at once and the data is written
+// in the background before ending the stream. The stream is aborted if the
+// peer does not read the data in 30 seconds.
+//
+// If sec == 0, Close discards the data and aborts the stream.
+//
+// If sec > 0, Close waits up to sec seconds for the data to be written
+// before ending the stream, and aborts it after that.
+func (c *conn) SetLinger(sec int) error {
+	if isClosedChan(c.done) {
+		return io.ErrClosedPipe
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.linger = time.Duration(sec) * time.Second
+	if sec < 0 {
+		c.linger = -1
+	}
+	return nil
+}
+
+// CloseWrite ends the writes of the connection, the peer reads io.EOF once
+// it reads the data written. The connection can still read until it is
+// closed.
+func (c *conn) CloseWrite() error {
+	if isClosedChan(c.done) {
+		return io.ErrClosedPipe
+	}
+	if c.getCloseWrite() == nil {
+		return errHalfCloseNotSupported
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !isClosedChan(c.wshut) {
+		close(c.wshut)
+	}
+	return nil
+}
+
+// CloseRead ends the reads of the connection, the data received is
+// discarded. The stream can not be ended on one direction by the reader,
+// so the peer is not notified.
+func (c *conn) CloseRead() error {
+	if isClosedChan(c.done) {
+		return io.ErrClosedPipe
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if !isClosedChan(c.rshut) {
+		close(c.rshut)
+	}
+	return nil
+}
+
+// addByteCounters adds counters of the bytes read and written.
+func (c *conn) addByteCounters(rx Counter, tx Counter) {
+	c.rmu.Lock()
+	c.rxCounters = append(c.rxCounters, rx)
+	c.rmu.Unlock()
+	c.wrMu.Lock()
+	c.txCounters = append(c.txCounters, tx)
+	c.wrMu.Unlock()
+}
+
+// countRead adds the bytes handed to Read to the counters.
+func (c *conn) countRead(n int) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for _, counter := range c.rxCounters {
+		counter.Add(float64(n))
+	}
+}
+
+// received accounts the bytes read, to know when the data of the peer ends.
+func (c *conn) received(n int64) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.rcount += n
+	if c.rlimit >= 0 && c.rcount >= c.rlimit && !isClosedChan(c.reof) {
+		close(c.reof)
+	}
+}
+
+// endRead returns io.EOF to the reads once the connection reads the bytes
+// of the offset, the peer ended its writes there.
+func (c *conn) endRead(offset int64) {
+	c.rmu.Lock()
+	c.rlimit = offset
+	c.rmu.Unlock()
+	c.received(0)
+}
+
+func (c *conn) setWriteSent(wsent <-chan struct{}) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wsent = wsent
+}
+
+func (c *conn) setCloseWrite(closeWrite func(sent int64) error) {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	c.closeWrite = closeWrite
+}
+
+func (c *conn) getCloseWrite() func(sent int64) error {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	return c.closeWrite
+}
+
+func (c *conn) setPeerDone(peerDone <-chan struct{}) {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	c.peerDone = peerDone
+}
+
+func (c *conn) peerDoneChan() <-chan struct{} {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	return c.peerDone
 }
 
 func (c *conn) Done() <-chan struct{} {
@@ -205,10 +637,16 @@ func (c *conn) Done() <-chan struct{} {
 }
 
 func (c *conn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
 	return connAddr{}
 }
 
 func (c *conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
 	return connAddr{}
 }
 
@@ -247,3 +685,36 @@ type connAddr struct{}
 
 func (connAddr) Network() string { return "conn" }
 func (connAddr) String() string  { return "conn" }
+
+// Addr is the address of a Listener, it identifies the reverse connections
+// of the id with the Dialer on the URL.
+type Addr struct {
+	ID  string
+	URL string
+}
+
+func (a *Addr) Network() string { return "h2rev2" }
+func (a *Addr) String() string  { return a.URL }
+
+// hostAddr is an address that is not an IP address, per example, a hostname
+type hostAddr string
+
+func (hostAddr) Network() string  { return "tcp" }
+func (a hostAddr) String() string { return string(a) }
+
+// parseAddr returns the net.Addr of the address, or nil if it is empty.
+func parseAddr(address string) net.Addr {
+	if address == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return hostAddr(address)
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return hostAddr(address)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/http/httptest"
 	"sync"
 	"testing"
@@ -103,6 +104,350 @@ func TestConn(t *testing.T) {
 
 }
 
+// TestConnShortRead tests that the bytes that do not fit on the buffer are
+// returned on the next reads.
+func TestConnShortRead(t *testing.T) {
+	pr, pw := io.Pipe()
+	c := newConn(pr, nopWriteCloser{ioutil.Discard})
+	defer c.Close()
+
+	want := make([]byte, 3*readBufSize+100)
+	rand.New(rand.NewSource(0)).Read(want)
+	go func() {
+		pw.Write(want)
+		pw.Close()
+	}()
+	got := new(bytes.Buffer)
+	buf := make([]byte, 7)
+	for {
+		n, err := c.Read(buf)
+		if n > len(buf) {
+			t.Fatalf("read %d bytes on a buffer of %d", n, len(buf))
+		}
+		got.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("read %d bytes, want %d bytes", got.Len(), len(want))
+	}
+}
+
+// TestConnWriteDeadline tests that the bytes reported by a Write that times
+// out are the bytes sent.
+func TestConnWriteDeadline(t *testing.T) {
+	pr, pw := io.Pipe()
+	// the peer does not write
+	rr, _ := io.Pipe()
+	c := newConn(rr, pw)
+
+	want := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(want)
+	c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := c.Write(want)
+	checkForTimeoutError(t, err)
+	if n == 0 || n == len(want) {
+		t.Fatalf("expected a partial write, got %d bytes", n)
+	}
+	go c.Close()
+	got, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[:n]) {
+		t.Errorf("sent %d bytes, Write reported %d bytes", len(got), n)
+	}
+}
+
+// TestConnCloseAbortsWrite tests that closing the connection aborts the
+// writes to a peer that does not read.
+func TestConnCloseAbortsWrite(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	rr, _ := io.Pipe()
+	c := newConn(rr, pw)
+	c.SetLinger(1)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Write(make([]byte, 1<<20))
+		errc <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("expected Write error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write not aborted")
+	}
+	if !isClosedChan(c.wdone) {
+		t.Error("writer not stopped")
+	}
+	if _, err := pr.Read(make([]byte, 1)); err != errWriteAborted {
+		t.Errorf("expected the peer to get %v, got %v", errWriteAborted, err)
+	}
+}
+
+// TestConnLinger tests the writes pending on Close with the linger modes,
+// the peer does not read until the connection is closed.
+func TestConnLinger(t *testing.T) {
+	tests := []struct {
+		name   string
+		linger int
+		// Close returns after wait
+		wait time.Duration
+		// the peer reads the data written or the stream is aborted
+		aborted bool
+	}{
+		{name: "background", linger: -1},
+		{name: "abort", linger: 0, aborted: true},
+		{name: "timeout", linger: 1, wait: time.Second, aborted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			defer pr.Close()
+			rr, _ := io.Pipe()
+			c := newConn(rr, pw)
+			if err := c.SetLinger(tt.linger); err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, writeBufSize)
+			rand.New(rand.NewSource(0)).Read(want)
+			if _, err := c.Write(want); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			c.Close()
+			if d := time.Since(start); d < tt.wait || d > tt.wait+time.Second {
+				t.Errorf("Close returned after %v, expected %v", d, tt.wait)
+			}
+			got, err := ioutil.ReadAll(pr)
+			if tt.aborted {
+				if err != errWriteAborted {
+					t.Errorf("expected %v, got %v", errWriteAborted, err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes %v, want %d bytes", len(got), err, len(want))
+			}
+		})
+	}
+}
+
+// TestConnWriteClose tests that the data written just before Close is read
+// by the peer, the stream is ended once the data is sent.
+func TestConnWriteClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// the side that writes and closes
+		first func(c1, c2 net.Conn) (net.Conn, net.Conn)
+	}{
+		{name: "pool", first: func(c1, c2 net.Conn) (net.Conn, net.Conn) { return c1, c2 }},
+		{name: "listener", first: func(c1, c2 net.Conn) (net.Conn, net.Conn) { return c2, c1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2, stop := connPair(t, NewReversePool())
+			defer stop()
+			a, b := tt.first(c1, c2)
+			b.SetDeadline(time.Now().Add(10 * time.Second))
+
+			// more than the flow control windows of HTTP/2
+			want := make([]byte, 4<<20)
+			rand.New(rand.NewSource(0)).Read(want)
+			go func() {
+				a.Write(want)
+				a.Close()
+			}()
+			got, err := ioutil.ReadAll(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, want %d bytes", len(got), len(want))
+			}
+			if reason := waitClosed(t, b); reason != ReasonClosed {
+				t.Errorf("expected reason %q, got %q", ReasonClosed, reason)
+			}
+		})
+	}
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		// the side that ends its writes first
+		first func(c1, c2 net.Conn) (net.Conn, net.Conn)
+	}{
+		{name: "pool", first: func(c1, c2 net.Conn) (net.Conn, net.Conn) { return c1, c2 }},
+		{name: "listener", first: func(c1, c2 net.Conn) (net.Conn, net.Conn) { return c2, c1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2, stop := connPair(t, NewReversePool())
+			defer stop()
+			a, b := tt.first(c1, c2)
+			a.SetDeadline(time.Now().Add(10 * time.Second))
+			b.SetDeadline(time.Now().Add(10 * time.Second))
+
+			if _, err := a.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.(closeWriter).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.Write([]byte("more")); err == nil {
+				t.Error("expected Write error after CloseWrite")
+			}
+			got, err := ioutil.ReadAll(b)
+			if err != nil || string(got) != "request" {
+				t.Fatalf("expected request and EOF, got %q %v", got, err)
+			}
+			// the other direction is still open
+			if _, err := b.Write([]byte("response")); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.(closeWriter).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			got, err = ioutil.ReadAll(a)
+			if err != nil || string(got) != "response" {
+				t.Fatalf("expected response and EOF, got %q %v", got, err)
+			}
+		})
+	}
+}
+
+func TestConnCloseRead(t *testing.T) {
+	c1, c2, stop := connPair(t, NewReversePool())
+	defer stop()
+	c1.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := c2.(*conn).CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF after CloseRead, got %v", err)
+	}
+	// the data of the peer is discarded
+	for i := 0; i < 10; i++ {
+		if _, err := c1.Write(make([]byte, 32*1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c2.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c1, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// size of the writes of the benchmarks
+const benchChunkSize = 32 * 1024
+
+// benchmarkRead reads b.N chunks from r
+func benchmarkRead(b *testing.B, r io.Reader) {
+	b.SetBytes(benchChunkSize)
+	b.ResetTimer()
+	buf := make([]byte, benchChunkSize)
+	if _, err := io.CopyBuffer(ioutil.Discard, io.LimitReader(r, int64(b.N)*benchChunkSize), buf); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+}
+
+// writeChunks writes n chunks to w
+func writeChunks(w io.Writer, n int) {
+	buf := make([]byte, benchChunkSize)
+	for i := 0; i < n; i++ {
+		if _, err := w.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func BenchmarkConnRead(b *testing.B) {
+	pr, pw := io.Pipe()
+	c := newConn(pr, nopWriteCloser{ioutil.Discard})
+	defer c.Close()
+	go writeChunks(pw, b.N)
+	benchmarkRead(b, c)
+}
+
+// BenchmarkHTTP2Stream is the baseline of BenchmarkConnHTTP2, it reads
+// the response body of an HTTP/2 stream.
+func BenchmarkHTTP2Stream(b *testing.B) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		writeChunks(flushWriter{w}, b.N)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer resp.Body.Close()
+	benchmarkRead(b, resp.Body)
+}
+
+// BenchmarkConnHTTP2 reads from a connection of a Listener the data written
+// on the pool side.
+func BenchmarkConnHTTP2(b *testing.B) {
+	pool := NewReversePool()
+	publicServer := httptest.NewUnstartedServer(pool)
+	publicServer.EnableHTTP2 = true
+	publicServer.StartTLS()
+	defer publicServer.Close()
+	defer pool.Close()
+
+	l, err := NewListener(publicServer.Client(), publicServer.URL, "d001")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	acceptc := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			acceptc <- c
+		}
+	}()
+	var d *Dialer
+	for i := 0; i < 50 && d == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		d = pool.GetDialer("d001")
+	}
+	if d == nil {
+		b.Fatal("dialer not ready")
+	}
+	c1, err := d.Dial(context.Background(), "tcp", "d001:80")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c1.Close()
+	c2 := <-acceptc
+	defer c2.Close()
+
+	go writeChunks(c1, b.N)
+	benchmarkRead(b, c2)
+}
+
 type connTester func(t *testing.T, c1, c2 net.Conn)
 
 func timeoutWrapper(t *testing.T, mp MakePipe, f connTester) {
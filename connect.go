@@ -0,0 +1,126 @@
+package h2rev2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+	"k8s.io/klog/v2"
+)
+
+// pseudo domain of the CONNECT targets <port>.<id>.tunnel
+const tunnelDomain = ".tunnel"
+
+// parseConnectTarget returns the id and the port of the target of a CONNECT
+// request, that can be <port>.<id>.tunnel:<any port> or <id>:<port>.
+func parseConnectTarget(authority string) (string, string, error) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return "", "", err
+	}
+	id := host
+	if strings.HasSuffix(host, tunnelDomain) {
+		labels := strings.SplitN(strings.TrimSuffix(host, tunnelDomain), ".", 2)
+		if len(labels) != 2 {
+			return "", "", fmt.Errorf("tunnel target %s must be <port>.<id>%s", host, tunnelDomain)
+		}
+		port, id = labels[0], labels[1]
+	}
+	if id == "" {
+		return "", "", fmt.Errorf("target %s without id", authority)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", "", fmt.Errorf("target %s with invalid port %s", authority, port)
+	}
+	return id, port, nil
+}
+
+// isProxyConnect returns true if the request is a CONNECT request of a
+// client using the pool as a forward proxy.
+func isProxyConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && !isExtendedConnect(r)
+}
+
+// serveConnect handles the CONNECT requests of the clients using the pool as
+// a forward proxy, it dials the port of the target through the reverse
+// connections of the id and splices the client connection to it.
+func (rp *ReversePool) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if !rp.EnableConnectProxy {
+		http.Error(w, "CONNECT not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, port, err := parseConnectTarget(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r, span, ok := rp.startProxy(w, r, id, attrAddress.String(r.Host))
+	if !ok {
+		return
+	}
+	defer span.End()
+	defer rp.streamDone()
+	d := rp.GetDialer(id)
+	if d == nil {
+		http.Error(w, "not reverse connections for this id available", http.StatusBadGateway)
+		return
+	}
+	// the Listener forwards the connection to its target with the port
+	c, err := d.dial(r.Context(), dialTarget{network: "tcp", address: net.JoinHostPort(id, port), portForward: true})
+	if err != nil {
+		klog.V(2).Infof("CONNECT to id %s port %s failed: %v", id, port, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer c.Close()
+
+	// HTTP/2 streams are piped, the HTTP/1 connections are hijacked
+	if r.ProtoMajor != 1 {
+		w.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		pipeStream(w, r, c, c)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	cc, brw, err := hj.Hijack()
+	if err != nil {
+		klog.V(2).Infof("CONNECT to id %s can not hijack the connection: %v", id, err)
+		return
+	}
+	defer cc.Close()
+	if _, err := io.WriteString(cc, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// the client may have sent data before the response
+	if err := copyBuffered(c, brw.Reader); err != nil {
+		return
+	}
+	pipe(cc, c)
+}
+
+// copyBuffered writes the data buffered by the reader to w.
+func copyBuffered(w io.Writer, br *bufio.Reader) error {
+	n := br.Buffered()
+	if n == 0 {
+		return nil
+	}
+	p, err := br.Peek(n)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(p)
+	return err
+}
@@ -0,0 +1,198 @@
+package h2rev2
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_parseConnectTarget(t *testing.T) {
+	tests := []struct {
+		authority string
+		id        string
+		port      string
+		wantErr   bool
+	}{
+		{authority: "2222.d001.tunnel:443", id: "d001", port: "2222"},
+		{authority: "22.my.dotted.id.tunnel:443", id: "my.dotted.id", port: "22"},
+		{authority: "d001:2222", id: "d001", port: "2222"},
+		{authority: "d001", wantErr: true},
+		{authority: "d001.tunnel:443", wantErr: true},
+		{authority: "ssh.d001.tunnel:443", wantErr: true},
+		{authority: "d001:70000", wantErr: true},
+		{authority: ":22", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.authority, func(t *testing.T) {
+			id, port, err := parseConnectTarget(tt.authority)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConnectTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if id != tt.id || port != tt.port {
+				t.Errorf("parseConnectTarget() = %s, %s, want %s, %s", id, port, tt.id, tt.port)
+			}
+		})
+	}
+}
+
+// connectHTTP1 sends a CONNECT request to the public server over HTTP/1.1,
+// with the header lines
+func connectHTTP1(t *testing.T, publicServer *httptest.Server, target string, header ...string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	u, err := url.Parse(publicServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := publicServer.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.NextProtos = nil
+	c, err := tls.Dial("tcp", u.Host, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	for _, h := range header {
+		fmt.Fprintf(c, "%s\r\n", h)
+	}
+	fmt.Fprintf(c, "\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, br, resp
+}
+
+func TestConnectProxy(t *testing.T) {
+	echoAddr, stopEcho := echoServer(t)
+	defer stopEcho()
+	pool := NewReversePool()
+	pool.EnableConnectProxy = true
+	publicServer, _, stop := setupPool(t, pool, WithTCPTargets(echoAddr))
+	defer stop()
+	port := addrPort(t, echoAddr)
+
+	for _, target := range []string{port + ".d001.tunnel:443", "d001:" + port} {
+		t.Run(target, func(t *testing.T) {
+			c, br, resp := connectHTTP1(t, publicServer, target)
+			defer c.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.StatusCode)
+			}
+			if _, err := c.Write([]byte("hello tunnel\n")); err != nil {
+				t.Fatal(err)
+			}
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != "hello tunnel\n" {
+				t.Errorf("expected echo, got %q", line)
+			}
+		})
+	}
+
+	// unknown ids are rejected
+	c, _, resp := connectHTTP1(t, publicServer, port+".d002.tunnel:443")
+	c.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected status 502, got %d", resp.StatusCode)
+	}
+}
+
+func TestConnectProxyHTTP2(t *testing.T) {
+	echoAddr, stopEcho := echoServer(t)
+	defer stopEcho()
+	pool := NewReversePool()
+	pool.EnableConnectProxy = true
+	publicServer, _, stop := setupPool(t, pool, WithTCPTargets(echoAddr))
+	defer stop()
+	port := addrPort(t, echoAddr)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequest(http.MethodConnect, publicServer.URL, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = port + ".d001.tunnel:443"
+	resp, err := publicServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected HTTP/2 200 response, got %s %d", resp.Proto, resp.StatusCode)
+	}
+	if _, err := pw.Write([]byte("hello tunnel\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello tunnel\n" {
+		t.Errorf("expected echo, got %q", line)
+	}
+}
+
+func TestConnectProxyDisabled(t *testing.T) {
+	publicServer, _, stop := setupPool(t, NewReversePool())
+	defer stop()
+
+	c, _, resp := connectHTTP1(t, publicServer, "22.d001.tunnel:443")
+	c.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestConnectProxyAuthorization(t *testing.T) {
+	pool := NewReversePool()
+	pool.Authorizer = TokenAuthorizer(map[string][]string{"clienttoken": {"d001"}})
+	pool.EnableConnectProxy = true
+	echoAddr, stopEcho := echoServer(t)
+	defer stopEcho()
+	publicServer, _, stop := setupPool(t, pool, WithTCPTargets(echoAddr))
+	defer stop()
+	port := addrPort(t, echoAddr)
+
+	target := port + ".d001.tunnel:443"
+	tests := []struct {
+		name   string
+		header []string
+		status int
+	}{
+		{name: "no credentials", status: http.StatusProxyAuthRequired},
+		{name: "invalid token", header: []string{"Proxy-Authorization: Bearer badtoken"}, status: http.StatusProxyAuthRequired},
+		// the proxy credentials are not read from the Authorization header
+		{name: "origin credentials", header: []string{"Authorization: Bearer clienttoken"}, status: http.StatusProxyAuthRequired},
+		{name: "valid token", header: []string{"Proxy-Authorization: Bearer clienttoken"}, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, resp := connectHTTP1(t, publicServer, target, tt.header...)
+			c.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if tt.status == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+				t.Errorf("expected Proxy-Authenticate header")
+			}
+		})
+	}
+
+	// tokens not scoped to the id are forbidden
+	c, _, resp := connectHTTP1(t, publicServer, port+".d002.tunnel:443", "Proxy-Authorization: Bearer clienttoken")
+	c.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", resp.StatusCode)
+	}
+}
@@ -4,9 +4,52 @@ package h2rev2
 // The listener connects to an user with path [host:port/base]/revdial?id=[id]
 // The dialer listens on the urls:
 // [host:port/base]/revdial for the reverse connections
+// [host:port/base]/revdial?id=[id]&session=[sid] for the control connections
+// [host:port/base]/revdial?id=[id]&conn=[token] for the connections requested by the dialer
+// [host:port/base]/revdial?id=[id]&session=[sid]&idle=true for the idle connections
 // [host:port/base]/proxy/[id]/[path] for the reverse proxied to [path]
+// The names revdial, proxy and id can be customized with URLOptions.
 const (
-	pathRevDial  = "revdial"
-	pathRevProxy = "proxy"
-	urlParamKey  = "id"
+	pathRevDial     = "revdial"
+	pathRevProxy    = "proxy"
+	urlParamKey     = "id"
+	urlParamConn    = "conn"
+	urlParamSession = "session"
+	urlParamIdle    = "idle"
 )
+
+// URLOptions are the names used on the URLs of the ReversePool, the empty
+// ones use the defaults. The Listeners must use the same RevDialPath and
+// IDParam as the ReversePool.
+type URLOptions struct {
+	// RevDialPath is the last element of the path of the reverse
+	// connections, "revdial" by default.
+	RevDialPath string
+	// ProxyPath is the element of the path, followed by the id, of the
+	// requests proxied, "proxy" by default.
+	ProxyPath string
+	// IDParam is the query parameter with the id of the reverse
+	// connections, "id" by default.
+	IDParam string
+}
+
+func (o URLOptions) revDialPath() string {
+	if o.RevDialPath == "" {
+		return pathRevDial
+	}
+	return o.RevDialPath
+}
+
+func (o URLOptions) proxyPath() string {
+	if o.ProxyPath == "" {
+		return pathRevProxy
+	}
+	return o.ProxyPath
+}
+
+func (o URLOptions) idParam() string {
+	if o.IDParam == "" {
+		return urlParamKey
+	}
+	return o.IDParam
+}
@@ -5,6 +5,8 @@ package h2rev2
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,51 +16,239 @@ import (
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 )
 
+// BalancingPolicy selects how the connections are spread across the
+// Listeners that share the same id.
+type BalancingPolicy int
+
+const (
+	// RoundRobin picks the Listeners in turn.
+	RoundRobin BalancingPolicy = iota
+	// LeastConnections picks the Listener with less active data connections.
+	LeastConnections
+)
+
+var errSessionClosed = errors.New("revdial: control connection closed")
+
 // The Dialer can create new connections back to the origin.
 // A Dialer can have multiple clients.
+// A Dialer can have multiple Listeners with the same id, each one with its
+// own control connection, the connections are balanced across them and
+// the Dialer is closed when the last control connection is closed.
 type Dialer struct {
-	id           string
-	conn         net.Conn      // control plane connection
-	incomingConn chan net.Conn // data plane connections
-	connReady    chan bool
-	pickupFailed chan error
-	donec        chan struct{}
-	closeOnce    sync.Once
-	revClient    *http.Client
+	// bytes read from and written to the data connections, accessed atomically
+	rxBytes byteCount
+	txBytes byteCount
+
+	id        string
+	created   time.Time
+	donec     chan struct{}
+	closeOnce sync.Once
+	revClient *http.Client
+	pool      *ReversePool // pool the Dialer belongs to, if any
+	metrics   metrics
+	tracer    trace.Tracer
+	balancing BalancingPolicy
+
+	mu          sync.Mutex
+	closed      bool
+	closeReason string
+	sessions    []*session              // control plane connections
+	next        int                     // next session for round robin
+	pending     map[string]*pendingDial // dials waiting for the data connection, by pick-up token
+	conns       map[string]*conn        // data connections open, by id
+}
+
+// session is a control plane connection with one of the Listeners.
+type session struct {
+	d          *Dialer
+	sid        string // identifies the control connection, set by the Listener
+	remoteAddr string // address of the Listener
+	connected  time.Time
+	conn       net.Conn
+	sendc      chan controlMsg // control messages to send to the Listener
+	idle       chan *idleConn  // idle data connections parked by the Listener
+	donec      chan struct{}
+	closeOnce  sync.Once
+	drainc     chan struct{} // closed when the Listener is draining
+	drainOnce  sync.Once
+
+	// guarded by d.mu
+	active       int      // data connections in use
+	draining     bool     // the Listener does not accept new connections
+	handshake    bool     // the Listener completed the handshake
+	version      int      // negotiated protocol version
+	agent        string   // software version of the Listener
+	capabilities []string // negotiated capabilities
+}
+
+// idleConn is a data connection parked by the Listener, its response headers
+// are sent once it is picked up, so the Listener can replace it.
+type idleConn struct {
+	conn   *conn
+	target chan dialTarget // connection requested by the dial that picked it up
+	ready  chan struct{}   // closed once the response headers are sent
+
+	// guarded by d.mu
+	sending   bool // the response headers are being sent
+	abandoned bool // the dial gave up before the response headers were sent
+}
+
+// pendingDial is a dial waiting for the Listener to pick up the connection
+type pendingDial struct {
+	s         *session
+	ch        chan pickup
+	abandoned bool // the dial gave up, the pick-up can not be delivered
+}
+
+// pickup is the result of a pick-up request to the Listener
+type pickup struct {
+	conn net.Conn
+	err  error
 }
 
 // NewDialer returns the side of the connection which will initiate
 // new connections over the already established reverse connections.
 func NewDialer(id string, conn net.Conn) *Dialer {
+	d := newDialer(id, nil)
+	d.addSession("", conn.RemoteAddr().String(), conn)
+	return d
+}
+
+func newDialer(id string, pool *ReversePool) *Dialer {
 	d := &Dialer{
-		id:           id,
-		conn:         conn,
-		donec:        make(chan struct{}),
-		connReady:    make(chan bool),
-		pickupFailed: make(chan error),
-		incomingConn: make(chan net.Conn),
-	}
-	go d.serve()
+		id:      id,
+		created: time.Now(),
+		pool:    pool,
+		donec:   make(chan struct{}),
+		pending: map[string]*pendingDial{},
+		conns:   map[string]*conn{},
+	}
+	var tp trace.TracerProvider
+	if pool != nil {
+		d.metrics = pool.metrics()
+		d.balancing = pool.Balancing
+		tp = pool.TracerProvider
+	}
+	d.tracer = newTracer(tp)
 	return d
 }
 
+// addSession adds a control connection to the Dialer, it returns nil
+// if the Dialer is closed.
+func (d *Dialer) addSession(sid string, remoteAddr string, conn net.Conn) *session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	s := &session{
+		d:          d,
+		sid:        sid,
+		remoteAddr: remoteAddr,
+		connected:  time.Now(),
+		conn:       conn,
+		sendc:      make(chan controlMsg),
+		idle:       make(chan *idleConn),
+		donec:      make(chan struct{}),
+		drainc:     make(chan struct{}),
+	}
+	d.sessions = append(d.sessions, s)
+	go s.serve()
+	// the Listeners that do not send the hello are not supported
+	timeout := handshakeTimeout
+	if d.pool != nil && d.pool.handshakeTimeout > 0 {
+		timeout = d.pool.handshakeTimeout
+	}
+	time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		ok := s.handshake
+		d.mu.Unlock()
+		if !ok && !isClosedChan(s.donec) {
+			log.Printf("revdial.Dialer: dialer %s: control connection from %s without handshake rejected, upgrade the Listener", d.id, remoteAddr)
+			s.Close()
+		}
+	})
+	return s
+}
+
+// removeSession removes the control connection, closing the Dialer
+// if it was the last one.
+func (d *Dialer) removeSession(s *session) {
+	d.mu.Lock()
+	for i, v := range d.sessions {
+		if v == s {
+			d.sessions = append(d.sessions[:i], d.sessions[i+1:]...)
+			break
+		}
+	}
+	last := len(d.sessions) == 0 && !d.closed
+	d.mu.Unlock()
+	if last {
+		d.closeWithReason(ReasonListenersGone)
+	}
+}
+
+// getSession returns the control connection identified by sid.
+func (d *Dialer) getSession(sid string) *session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.sessions {
+		if s.sid != "" && s.sid == sid {
+			return s
+		}
+	}
+	return nil
+}
+
+// pickSession returns the session to use for the next connection,
+// the Listeners draining are skipped.
+func (d *Dialer) pickSession() (*session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed || len(d.sessions) == 0 {
+		return nil, errors.New("revdial.Dialer closed")
+	}
+	start := d.next % len(d.sessions)
+	d.next++
+	var s *session
+	for i := 0; i < len(d.sessions); i++ {
+		v := d.sessions[(start+i)%len(d.sessions)]
+		if v.draining {
+			continue
+		}
+		if s == nil {
+			s = v
+			if d.balancing != LeastConnections {
+				break
+			}
+		} else if v.active < s.active {
+			s = v
+		}
+	}
+	if s == nil {
+		return nil, errors.New("revdial.Dialer draining")
+	}
+	return s, nil
+}
+
 // serve blocks and runs the control message loop, keeping the peer
 // alive and notifying the peer when new connections are available.
-func (d *Dialer) serve() error {
-	defer d.Close()
+func (s *session) serve() error {
+	defer s.Close()
 	go func() {
-		defer d.Close()
-		br := bufio.NewReader(d.conn)
+		defer s.Close()
+		br := bufio.NewReader(s.conn)
 		for {
 			line, err := br.ReadSlice('\n')
 			if err != nil {
 				return
 			}
 			select {
-			case <-d.donec:
+			case <-s.donec:
 				return
 			default:
 			}
@@ -68,40 +258,159 @@ func (d *Dialer) serve() error {
 				return
 			}
 			switch msg.Command {
+			case "hello":
+				s.handleHello(msg)
 			case "pickup-failed":
+				s.d.metrics.pickupFailed(s.d.id)
 				err := fmt.Errorf("revdial listener failed to pick up connection: %v", msg.Err)
-				select {
-				case d.pickupFailed <- err:
-				case <-d.donec:
-					return
+				// retry on the other Listeners
+				if s.isDraining() {
+					err = errSessionClosed
 				}
+				s.d.deliver(msg.ConnPath, pickup{err: err})
+			case "drain":
+				s.drain()
+			case "conn-close":
+				go s.d.closeConn(msg.ConnPath, msg.Err)
+			case "expose-tcp":
+				go s.exposeTCP(msg)
 			}
 		}
 	}()
 	for {
 		select {
-		case <-d.connReady:
-			if err := d.sendMessage(controlMsg{
-				Command:  "conn-ready",
-				ConnPath: "",
-			}); err != nil {
+		case msg := <-s.sendc:
+			if err := s.sendMessage(msg); err != nil {
 				return err
 			}
-		case <-d.donec:
-			return errors.New("revdial.Dialer closed")
+			// the peer was rejected
+			if msg.Command == "hello-ack" && msg.Err != "" {
+				return ErrIncompatiblePeer
+			}
+		case <-s.donec:
+			return errSessionClosed
 		}
 	}
 }
 
-func (d *Dialer) sendMessage(m controlMsg) error {
+func (s *session) sendMessage(m controlMsg) error {
 	j, _ := json.Marshal(m)
-	d.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 	j = append(j, '\n')
-	_, err := d.conn.Write(j)
-	d.conn.SetWriteDeadline(time.Time{})
+	_, err := s.conn.Write(j)
+	s.conn.SetWriteDeadline(time.Time{})
 	return err
 }
 
+// queueMessage sends the message through the control loop
+func (s *session) queueMessage(ctx context.Context, m controlMsg) error {
+	select {
+	case s.sendc <- m:
+		return nil
+	case <-s.donec:
+		return errSessionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleHello negotiates the protocol version and the capabilities with the
+// Listener, the control connection is closed if the Listener is rejected.
+func (s *session) handleHello(msg controlMsg) {
+	ack := controlMsg{Command: "hello-ack", Version: ProtocolVersion}
+	if s.d.pool != nil {
+		ack.Agent = s.d.pool.ServerVersion
+	}
+	if err := s.d.checkPeer(msg); err != nil {
+		klog.V(2).Infof("dialer %s: rejected Listener %s: %v", s.d.id, msg.Agent, err)
+		ack.Err = err.Error()
+		s.queueMessage(context.Background(), ack)
+		return
+	}
+	if msg.Version < ack.Version {
+		ack.Version = msg.Version
+	}
+	ack.Capabilities = intersect(msg.Capabilities, supportedCapabilities)
+	s.d.mu.Lock()
+	s.handshake = true
+	s.version = ack.Version
+	s.agent = msg.Agent
+	s.capabilities = ack.Capabilities
+	s.d.mu.Unlock()
+	klog.V(5).Infof("dialer %s: Listener %s protocol version %d capabilities %v", s.d.id, msg.Agent, ack.Version, ack.Capabilities)
+	s.queueMessage(context.Background(), ack)
+}
+
+// checkPeer returns an error if the Listener is not compatible.
+func (d *Dialer) checkPeer(msg controlMsg) error {
+	if d.pool == nil {
+		return nil
+	}
+	if msg.Version < d.pool.MinProtocolVersion {
+		return fmt.Errorf("protocol version %d not supported, minimum version %d", msg.Version, d.pool.MinProtocolVersion)
+	}
+	for _, c := range d.pool.RequiredCapabilities {
+		if !strSliceContains(msg.Capabilities, c) {
+			return fmt.Errorf("required capability %s not supported", c)
+		}
+	}
+	return nil
+}
+
+// hasCapability returns true if the capability was negotiated with the Listener.
+func (s *session) hasCapability(c string) bool {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	return strSliceContains(s.capabilities, c)
+}
+
+// exposeTCP handles the request of the Listener to expose a TCP port
+// on the public host.
+func (s *session) exposeTCP(msg controlMsg) {
+	reply := controlMsg{Command: "expose-tcp-result", Address: msg.Address, Forward: msg.Forward}
+	if !s.hasCapability(CapabilityTCPExpose) {
+		reply.Err = "TCP exposure not negotiated"
+	} else if s.d.pool == nil {
+		reply.Err = "TCP exposure not supported"
+	} else if addr, err := s.d.pool.exposeTCP(s.d, msg.Address, msg.Forward); err != nil {
+		reply.Err = err.Error()
+	} else {
+		reply.Address = addr.String()
+	}
+	s.queueMessage(context.Background(), reply)
+}
+
+// drain stops using the session for new connections, the Listener keeps
+// serving the active ones until it closes the control connection.
+func (s *session) drain() {
+	s.drainOnce.Do(func() {
+		klog.V(2).Infof("dialer %s: Listener draining", s.d.id)
+		s.d.mu.Lock()
+		s.draining = true
+		s.d.mu.Unlock()
+		close(s.drainc)
+	})
+}
+
+func (s *session) isDraining() bool {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	return s.draining
+}
+
+// Done returns a channel which is closed when the control connection is closed.
+func (s *session) Done() <-chan struct{} { return s.donec }
+
+// Close closes the control connection and removes it from the Dialer.
+func (s *session) Close() error {
+	s.closeOnce.Do(func() {
+		s.conn.Close()
+		close(s.donec)
+		s.d.removeSession(s)
+	})
+	return nil
+}
+
 // Done returns a channel which is closed when d is closed (either by
 // this process on purpose, by a local error, or close or error from
 // the peer).
@@ -109,13 +418,35 @@ func (d *Dialer) Done() <-chan struct{} { return d.donec }
 
 // Close closes the Dialer.
 func (d *Dialer) Close() error {
+	return d.closeWithReason(ReasonClosed)
+}
+
+// closeWithReason closes the Dialer, the reason is reported on the event.
+func (d *Dialer) closeWithReason(reason string) error {
+	d.mu.Lock()
+	if d.closeReason == "" {
+		d.closeReason = reason
+	}
+	d.mu.Unlock()
 	d.closeOnce.Do(d.close)
 	return nil
 }
 
 func (d *Dialer) close() {
-	d.conn.Close()
+	d.mu.Lock()
+	d.closed = true
+	sessions := d.sessions
+	d.sessions = nil
+	reason := d.closeReason
+	d.mu.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
 	close(d.donec)
+	if d.pool != nil {
+		now := time.Now()
+		d.pool.Hooks.dialerClosed(DialerEvent{ID: d.id, Time: now, Duration: now.Sub(d.created), Reason: reason})
+	}
 }
 
 // reverseClient caches the reverse http client
@@ -140,27 +471,340 @@ func (d *Dialer) reverseClient() *http.Client {
 }
 
 // Dial creates a new connection back to the Listener.
+// The network and address are passed to the Listener, that exposes them
+// on the accepted connection or, if it is an egress gateway, dials them.
 func (d *Dialer) Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	return d.dial(ctx, dialTarget{network: network, address: address})
+}
+
+// dial creates a new connection back to one of the Listeners, failing over
+// to the others if its control connection is closed.
+func (d *Dialer) dial(ctx context.Context, t dialTarget) (c net.Conn, err error) {
 	now := time.Now()
-	defer klog.V(5).Infof("dial to %s took %v", address, time.Since(now))
+	parent := ctx
+	ctx, span := d.tracer.Start(ctx, spanDial,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrID.String(d.id), attrNetwork.String(t.network), attrAddress.String(t.address), attrForward.String(t.forward)),
+	)
+	defer func() {
+		d.metrics.observeDial(now, err)
+		endSpan(span, err)
+		klog.V(5).Infof("dial to %s took %v", d.id, time.Since(now))
+		if err == nil {
+			d.traceConn(parent, c)
+		}
+	}()
+	// the Listener continues the trace
+	t.trace = injectTrace(ctx)
+	if ci, ok := ctx.Value(clientKey{}).(clientInfo); ok {
+		t.remoteAddr = ci.remoteAddr
+		t.host = ci.host
+	}
+
+	for {
+		s, err := d.pickSession()
+		if err != nil {
+			return nil, err
+		}
+		c, err := d.dialSession(ctx, s, t)
+		if err == errSessionClosed {
+			klog.V(5).Infof("control connection of %s closed during dial, retrying", d.id)
+			continue
+		}
+		return c, err
+	}
+}
+
+// traceConn records the lifetime of the data connection c in a span.
+func (d *Dialer) traceConn(ctx context.Context, c net.Conn) {
+	cc, ok := c.(*conn)
+	if !ok {
+		return
+	}
+	_, span := d.tracer.Start(ctx, spanConn, trace.WithAttributes(attrID.String(d.id)))
+	if !span.IsRecording() {
+		return
+	}
+	go func() {
+		<-cc.Done()
+		span.End()
+	}()
+}
+
+// dialSession requests a new connection to the Listener of the session.
+func (d *Dialer) dialSession(ctx context.Context, s *session, t dialTarget) (c net.Conn, err error) {
+	if t.forward != "" && !s.hasCapability(CapabilityTCPForward) {
+		return nil, fmt.Errorf("revdial: listener does not support forwarding connections")
+	}
+	// use an idle connection if there is one parked, they can not
+	// be used to forward connections to a configured target.
+	if t.forward == "" {
+		select {
+		case ic := <-s.idle:
+			trace.SpanFromContext(ctx).SetAttributes(attrIdle.Bool(true))
+			d.mu.Lock()
+			s.active++
+			d.mu.Unlock()
+			ic.target <- t
+			select {
+			case <-ic.ready:
+				return ic.conn, nil
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-d.donec:
+				err = errors.New("revdial.Dialer closed")
+			}
+			// give up unless the response headers are being sent, the
+			// handler parks the connection again then
+			if d.abandonIdle(s, ic) {
+				return nil, err
+			}
+			select {
+			case <-ic.ready:
+				return ic.conn, nil
+			case <-s.donec:
+				ic.conn.Close()
+				return nil, errSessionClosed
+			case <-d.donec:
+				ic.conn.Close()
+				return nil, errors.New("revdial.Dialer closed")
+			}
+		default:
+		}
+	}
+
+	token := newPickupToken()
+	ch := make(chan pickup, 1)
+	pd := &pendingDial{s: s, ch: ch}
+	d.mu.Lock()
+	d.pending[token] = pd
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, token)
+		// a pick-up already claimed is not delivered once the dial gave up
+		if err != nil {
+			pd.abandoned = true
+		}
+		d.mu.Unlock()
+		// the connection may have been delivered after giving up
+		if err != nil {
+			select {
+			case p := <-ch:
+				if p.conn != nil {
+					p.conn.Close()
+				}
+			default:
+			}
+		}
+	}()
+
 	// First, tell serve that we want a connection:
+	err = s.queueMessage(ctx, controlMsg{
+		Command:     "conn-ready",
+		ConnPath:    token,
+		Forward:     t.forward,
+		Network:     t.network,
+		Address:     t.address,
+		RemoteAddr:  t.remoteAddr,
+		Host:        t.host,
+		Trace:       t.trace,
+		PortForward: t.portForward,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Then pick it up:
 	select {
-	case d.connReady <- true:
+	case p := <-ch:
+		return p.conn, p.err
+	case <-s.donec:
+		return nil, errSessionClosed
 	case <-d.donec:
 		return nil, errors.New("revdial.Dialer closed")
 	case <-ctx.Done():
+	}
+	// give up unless the pick-up was claimed, the Listener got the response
+	// then and the connection is delivered once the headers are sent
+	d.mu.Lock()
+	_, waiting := d.pending[token]
+	delete(d.pending, token)
+	d.mu.Unlock()
+	if waiting {
 		return nil, ctx.Err()
 	}
-
-	// Then pick it up:
 	select {
-	case c := <-d.incomingConn:
-		return c, nil
-	case err := <-d.pickupFailed:
-		return nil, err
+	case p := <-ch:
+		return p.conn, p.err
+	case <-s.donec:
+		return nil, errSessionClosed
 	case <-d.donec:
 		return nil, errors.New("revdial.Dialer closed")
-	case <-ctx.Done():
-		return nil, ctx.Err()
 	}
 }
+
+// claim takes the dial waiting for the pick-up token, so no other pick-up
+// can be delivered to it, it returns false if there is no dial waiting.
+func (d *Dialer) claim(token string) (*pendingDial, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pd, ok := d.pending[token]
+	if !ok {
+		return nil, false
+	}
+	delete(d.pending, token)
+	return pd, true
+}
+
+// deliver hands the result of a pick-up to the dial waiting for it, it
+// returns the session that requested it or false if there is no dial waiting.
+// The connections delivered are accounted as active until release is called.
+func (d *Dialer) deliver(token string, p pickup) (*session, bool) {
+	pd, ok := d.claim(token)
+	if !ok {
+		return nil, false
+	}
+	return d.complete(pd, p)
+}
+
+// complete hands the result of a pick-up to the claimed dial pd, it returns
+// false if the dial gave up since it was claimed.
+func (d *Dialer) complete(pd *pendingDial, p pickup) (*session, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if pd.abandoned {
+		return nil, false
+	}
+	if p.conn != nil {
+		pd.s.active++
+		if c, ok := p.conn.(*conn); ok && strSliceContains(pd.s.capabilities, CapabilityHalfClose) {
+			pd.s.halfClose(c)
+		}
+	}
+	pd.ch <- p
+	return pd.s, true
+}
+
+// trackConn accounts the bytes of the data connection c, and keeps it
+// until it is closed so it can be closed if the Dialer is disconnected.
+// It also applies the timeouts of the pool to the connection.
+func (d *Dialer) trackConn(c *conn) {
+	var rx, tx byteCount
+	c.addByteCounters(&d.rxBytes, &d.txBytes)
+	c.addByteCounters(&rx, &tx)
+	// the timers are set before a conn-close message can close c
+	if d.pool != nil {
+		c.setTimeouts(d.pool.ConnIdleTimeout, d.pool.ConnMaxLifetime)
+	}
+	d.mu.Lock()
+	d.conns[c.id] = c
+	d.mu.Unlock()
+	opened := time.Now()
+	if d.pool != nil {
+		d.pool.Hooks.connOpened(ConnEvent{ID: d.id, Time: opened})
+	}
+	go func() {
+		<-c.Done()
+		d.mu.Lock()
+		delete(d.conns, c.id)
+		d.mu.Unlock()
+		if d.pool != nil {
+			now := time.Now()
+			d.pool.Hooks.connClosed(ConnEvent{
+				ID:       d.id,
+				Time:     now,
+				Duration: now.Sub(opened),
+				RxBytes:  rx.load(),
+				TxBytes:  tx.load(),
+				Reason:   c.closeReason(),
+			})
+		}
+	}()
+}
+
+// closeConns closes all the data connections of the Dialer.
+func (d *Dialer) closeConns(reason string) {
+	d.mu.Lock()
+	conns := make([]*conn, 0, len(d.conns))
+	for _, c := range d.conns {
+		conns = append(conns, c)
+	}
+	d.mu.Unlock()
+	for _, c := range conns {
+		c.closeWithReason(reason)
+	}
+}
+
+// closeConn closes the data connection with the id on behalf of the Listener,
+// so the reason reaches both sides.
+func (d *Dialer) closeConn(id string, reason string) {
+	d.mu.Lock()
+	c, ok := d.conns[id]
+	d.mu.Unlock()
+	if ok {
+		c.closeWithReason(reason)
+	}
+}
+
+// halfClose allows the connection c with the Listener of the session to
+// end its writes, if the Listener negotiated CapabilityHalfClose. The pool
+// can not end the response while it reads the request, so it tells the
+// Listener where the data ends instead.
+func (s *session) halfClose(c *conn) {
+	c.setCloseWrite(func(sent int64) error {
+		// the Listener does not know where the data ends without the
+		// control connection, the connection is closed then
+		go func() {
+			select {
+			case <-s.donec:
+				c.Close()
+			case <-c.done:
+			}
+		}()
+		return s.queueMessage(context.Background(), controlMsg{Command: "conn-close-write", ConnPath: c.id, Offset: sent})
+	})
+}
+
+// release stops accounting a data connection of the session as active.
+func (d *Dialer) release(s *session) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s.active--
+}
+
+// sendIdle marks the idle connection ic picked up as being sent, it returns
+// false if the dial gave up, then the connection can be parked again.
+func (d *Dialer) sendIdle(ic *idleConn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ic.abandoned {
+		ic.abandoned = false
+		return false
+	}
+	ic.sending = true
+	return true
+}
+
+// abandonIdle gives up the idle connection ic picked up by a dial on the
+// session s, it returns false if its response headers are being sent.
+func (d *Dialer) abandonIdle(s *session, ic *idleConn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ic.sending {
+		return false
+	}
+	ic.abandoned = true
+	s.active--
+	return true
+}
+
+// newPickupToken returns a random token to correlate the data connections
+// with the requests for them.
+func newPickupToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
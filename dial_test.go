@@ -0,0 +1,199 @@
+package h2rev2
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serveName accepts connections and replies with the name of the Listener
+func serveName(l *Listener, name string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			c.Write([]byte(name))
+			c.Close()
+		}()
+	}
+}
+
+func dialName(t *testing.T, d *Dialer) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := d.Dial(ctx, "", "")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer c.Close()
+	// all the names have the same length
+	name := make([]byte, 2)
+	if _, err := io.ReadFull(c, name); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return string(name)
+}
+
+func TestDialerMultipleListeners(t *testing.T) {
+	for _, policy := range []BalancingPolicy{RoundRobin, LeastConnections} {
+		pool := NewReversePool()
+		pool.Balancing = policy
+		publicServer, l1, stop := setupPool(t, pool)
+		go serveName(l1, "l1")
+		l2, err := NewListener(publicServer.Client(), publicServer.URL, "d001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveName(l2, "l2")
+
+		var d *Dialer
+		for i := 0; i < 10; i++ {
+			d = pool.GetDialer("d001")
+			if d != nil {
+				d.mu.Lock()
+				n := len(d.sessions)
+				d.mu.Unlock()
+				if n == 2 {
+					break
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if d == nil {
+			t.Fatal("dialer not registered")
+		}
+
+		// both Listeners get connections
+		got := map[string]int{}
+		for i := 0; i < 10; i++ {
+			got[dialName(t, d)]++
+		}
+		if got["l1"] == 0 || got["l2"] == 0 {
+			t.Errorf("policy %d: connections not balanced: %v", policy, got)
+		}
+
+		// the remaining Listener gets all the connections
+		l1.Close()
+		for i := 0; i < 10; i++ {
+			d.mu.Lock()
+			n := len(d.sessions)
+			d.mu.Unlock()
+			if n == 1 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 5; i++ {
+			if name := dialName(t, d); name != "l2" {
+				t.Errorf("policy %d: expected connection from l2, got %s", policy, name)
+			}
+		}
+		if isClosedChan(d.Done()) {
+			t.Errorf("dialer closed with Listeners connected")
+		}
+
+		// the dialer is closed with the last Listener
+		l2.Close()
+		select {
+		case <-d.Done():
+		case <-time.After(5 * time.Second):
+			t.Errorf("dialer not closed after the last Listener")
+		}
+		stop()
+	}
+}
+
+// TestDialIdleConnNotReady checks the dial of an idle connection gives up
+// until its response headers are being sent.
+func TestDialIdleConnNotReady(t *testing.T) {
+	for _, mode := range []string{"context", "close"} {
+		t.Run(mode, func(t *testing.T) {
+			d := newDialer("d001", nil)
+			s := &session{d: d, idle: make(chan *idleConn, 1), donec: make(chan struct{})}
+			pr, _ := io.Pipe()
+			ic := &idleConn{conn: newConn(pr, nopWriteCloser{io.Discard}), target: make(chan dialTarget, 1), ready: make(chan struct{})}
+			defer ic.conn.Close()
+			s.idle <- ic
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errc := make(chan error, 1)
+			go func() {
+				_, err := d.dialSession(ctx, s, dialTarget{})
+				errc <- err
+			}()
+			<-ic.target
+			if mode == "context" {
+				cancel()
+			} else {
+				d.Close()
+			}
+			select {
+			case err := <-errc:
+				if err == nil {
+					t.Fatal("expected error")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("dial blocked on the idle connection")
+			}
+			// the handler parks the connection again
+			if d.sendIdle(ic) {
+				t.Errorf("idle connection sent after the dial gave up")
+			}
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if s.active != 0 {
+				t.Errorf("expected no active connections, got %d", s.active)
+			}
+		})
+	}
+}
+
+// TestDialerLegacyListener checks the connections of the Listeners without
+// sessions, that dial the control and the data connections on the same URL,
+// are rejected instead of being registered as control connections.
+func TestDialerLegacyListener(t *testing.T) {
+	pool := NewReversePool()
+	publicServer, l, stop := setupPool(t, pool)
+	defer stop()
+	go serveName(l, "l1")
+	d := pool.GetDialer("d001")
+
+	// the control connection of a new id and the data connections of an id
+	// already registered
+	for _, id := range []string{"d002", "d001", "d001"} {
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest("GET", publicServer.URL+"/revdial?id="+id, pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := publicServer.Client().Do(req)
+		pw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUpgradeRequired {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUpgradeRequired)
+		}
+	}
+	if pool.GetDialer("d002") != nil {
+		t.Errorf("Listener without session registered")
+	}
+	d.mu.Lock()
+	sessions := len(d.sessions)
+	d.mu.Unlock()
+	if sessions != 1 {
+		t.Errorf("expected 1 control connection, got %d", sessions)
+	}
+	for i := 0; i < 4; i++ {
+		if name := dialName(t, d); name != "l1" {
+			t.Errorf("expected connection from l1, got %q", name)
+		}
+	}
+}
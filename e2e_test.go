@@ -1,13 +1,17 @@
 package h2rev2
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -189,3 +193,298 @@ func Test_e2e_listener_reconnect(t *testing.T) {
 		t.Errorf("Expected %s received %s", "Hello world", bodyString)
 	}
 }
+
+// setupPool serves the pool on a public server with the Listener d001, created
+// with the options, and waits for its handshake. stop closes the Listener,
+// the public server and the pool.
+func setupPool(t *testing.T, pool *ReversePool, opts ...ListenerOption) (*httptest.Server, *Listener, func()) {
+	t.Helper()
+	return setupHandler(t, pool, pool, "", opts...)
+}
+
+// setupHandler is setupPool with the handler serving the public server, and
+// the Listener connected to the pool on its base path.
+func setupHandler(t *testing.T, pool *ReversePool, handler http.Handler, base string, opts ...ListenerOption) (*httptest.Server, *Listener, func()) {
+	t.Helper()
+	publicServer := httptest.NewUnstartedServer(handler)
+	publicServer.EnableHTTP2 = true
+	publicServer.StartTLS()
+
+	// private server
+	l, err := NewListener(publicServer.Client(), publicServer.URL+base, "d001", opts...)
+	if err != nil {
+		publicServer.Close()
+		t.Fatal(err)
+	}
+	waitHandshake(t, pool, "d001")
+	return publicServer, l, func() {
+		l.Close()
+		publicServer.Close()
+		pool.Close()
+		publicServer.Client().CloseIdleConnections()
+	}
+}
+
+// serveHello serves on the Listener a reverse proxy to an internal host that
+// replies "Hello world"
+func serveHello(t *testing.T, l net.Listener) func() {
+	t.Helper()
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello world")
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+
+	url, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy.Transport = backend.Client().Transport
+	server := &http.Server{Handler: proxy}
+	go server.Serve(l)
+	return func() {
+		server.Close()
+		backend.Close()
+	}
+}
+
+func Test_e2e_listener_control_reconnect(t *testing.T) {
+	pool := NewReversePool()
+	publicServer, l, stop := setupPool(t, pool)
+	defer stop()
+	defer serveHello(t, l)()
+
+	d := pool.GetDialer("d001")
+	if d == nil {
+		t.Fatal("dialer not registered")
+	}
+	// drop the control connection from the public server
+	d.Close()
+
+	// the listener has to reconnect without closing the server
+	var d2 *Dialer
+	for i := 0; i < 10; i++ {
+		d2 = pool.GetDialer("d001")
+		if d2 != nil && d2 != d && !isClosedChan(d2.Done()) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if d2 == nil || d2 == d {
+		t.Fatal("listener did not reconnect")
+	}
+	if isClosedChan(l.donec) {
+		t.Fatal("listener closed")
+	}
+
+	client := publicServer.Client()
+	resp, err := client.Get(publicServer.URL + "/proxy/d001/")
+	if err != nil {
+		t.Fatalf("Request Failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading body failed: %s", err)
+	}
+	if string(body) != "Hello world" {
+		t.Errorf("Expected %s received %s", "Hello world", string(body))
+	}
+}
+
+// Test_e2e_listener_control_dropped checks the Listener backs off when the
+// control connections are dropped once accepted.
+func Test_e2e_listener_control_dropped(t *testing.T) {
+	var connected int64
+	pool := NewReversePool()
+	_, l, stop := setupPool(t, pool, WithHooks(ListenerHooks{
+		OnConnected: func(ListenerEvent) { atomic.AddInt64(&connected, 1) },
+	}))
+	defer stop()
+
+	// drop the control connections as soon as they are registered
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if d := pool.GetDialer("d001"); d != nil {
+			d.Close()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if isClosedChan(l.donec) {
+		t.Fatal("listener closed")
+	}
+	// the backoff starts at 1s and doubles, without it the Listener
+	// reconnects right away
+	if n := atomic.LoadInt64(&connected); n > 4 {
+		t.Errorf("expected at most 4 control connections, got %d", n)
+	}
+}
+
+func Test_e2e_listener_permanent_error(t *testing.T) {
+	publicServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	publicServer.EnableHTTP2 = true
+	publicServer.StartTLS()
+	defer publicServer.Close()
+
+	start := time.Now()
+	_, err := NewListener(publicServer.Client(), publicServer.URL, "d001")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !isPermanentError(err) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+	// permanent errors are not retried
+	if time.Since(start) > time.Second {
+		t.Errorf("permanent error retried, took %v", time.Since(start))
+	}
+}
+
+func Test_e2e_idle_connections(t *testing.T) {
+	// public server counting the type of connections
+	pool := NewReversePool()
+	var mu sync.Mutex
+	var idle, requested int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.URL.Query().Get(urlParamIdle) != "" {
+			idle++
+		}
+		if r.URL.Query().Get(urlParamConn) != "" {
+			requested++
+		}
+		mu.Unlock()
+		pool.ServeHTTP(w, r)
+	})
+	_, l, stop := setupHandler(t, pool, handler, "", WithIdleConns(2))
+	defer stop()
+	go serveName(l, "l1")
+
+	// wait for the idle connections to be parked
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	if idle != 2 {
+		t.Errorf("expected 2 idle connections, got %d", idle)
+	}
+	mu.Unlock()
+
+	d := pool.GetDialer("d001")
+	if d == nil {
+		t.Fatal("dialer not registered")
+	}
+	for i := 0; i < 4; i++ {
+		if name := dialName(t, d); name != "l1" {
+			t.Errorf("expected connection from l1, got %s", name)
+		}
+		// give time to replenish the idle connections
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requested != 0 {
+		t.Errorf("expected connections served from the idle ones, got %d requested", requested)
+	}
+	if idle != 6 {
+		t.Errorf("expected idle connections to be replenished, got %d", idle)
+	}
+}
+
+// Test_e2e_idle_connections_in_flight checks that the connections picked up
+// from the idle ones outlive the control connection that parked them.
+func Test_e2e_idle_connections_in_flight(t *testing.T) {
+	for _, mode := range []string{"shutdown", "reconnect"} {
+		t.Run(mode, func(t *testing.T) {
+			pool := NewReversePool()
+			var mu sync.Mutex
+			var requested int
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				if r.URL.Query().Get(urlParamConn) != "" {
+					requested++
+				}
+				mu.Unlock()
+				pool.ServeHTTP(w, r)
+			})
+			_, l, stop := setupHandler(t, pool, handler, "", WithIdleConns(1))
+			defer stop()
+			// wait for the idle connection to be parked
+			time.Sleep(500 * time.Millisecond)
+
+			acceptc := make(chan net.Conn, 1)
+			go func() {
+				c, err := l.Accept()
+				if err == nil {
+					acceptc <- c
+				}
+			}()
+			d := pool.GetDialer("d001")
+			c1, err := d.Dial(context.Background(), "tcp", "d001:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c1.Close()
+			var c2 net.Conn
+			select {
+			case c2 = <-acceptc:
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection not accepted")
+			}
+			defer c2.Close()
+			mu.Lock()
+			if requested != 0 {
+				t.Fatalf("connection not picked up from the idle ones")
+			}
+			mu.Unlock()
+
+			roundTrip := func() {
+				t.Helper()
+				c1.SetDeadline(time.Now().Add(5 * time.Second))
+				c2.SetDeadline(time.Now().Add(5 * time.Second))
+				msg := []byte("ping\n")
+				b := make([]byte, len(msg))
+				if _, err := c1.Write(msg); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadFull(c2, b); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := c2.Write(b); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadFull(c1, b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			roundTrip()
+
+			shutdownc := make(chan error, 1)
+			switch mode {
+			case "shutdown":
+				go func() {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					shutdownc <- l.Shutdown(ctx)
+				}()
+			case "reconnect":
+				d.Close()
+				waitHandshake(t, pool, "d001")
+			}
+			// give time to the parked connections to go away
+			time.Sleep(200 * time.Millisecond)
+			roundTrip()
+
+			if mode == "shutdown" {
+				c1.Close()
+				c2.Close()
+				if err := <-shutdownc; err != nil {
+					t.Errorf("shutdown failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package h2rev2
+
+import (
+	"time"
+)
+
+// Reasons reported on the events when a Dialer or a data connection is closed.
+const (
+	// ReasonClosed is reported when Dialer.Close is called or the data
+	// connection is closed by one of its ends.
+	ReasonClosed = "closed"
+	// ReasonListenersGone is reported when the control connection of the
+	// last Listener of the Dialer is closed.
+	ReasonListenersGone = "listeners disconnected"
+	// ReasonDisconnected is reported when the Dialer is disconnected with
+	// ReversePool.DisconnectDialer.
+	ReasonDisconnected = "disconnected"
+	// ReasonBlocked is reported when the Dialer is blocked with
+	// ReversePool.BlockDialer.
+	ReasonBlocked = "blocked"
+	// ReasonPoolClosed is reported when the ReversePool is closed.
+	ReasonPoolClosed = "pool closed"
+	// ReasonIdleTimeout is reported when a data connection does not read or
+	// write data during the idle timeout.
+	ReasonIdleTimeout = "idle timeout"
+	// ReasonMaxLifetime is reported when a data connection is open for
+	// longer than its maximum lifetime.
+	ReasonMaxLifetime = "max lifetime"
+)
+
+// DialerEvent describes a change on a Dialer of the ReversePool.
+type DialerEvent struct {
+	ID   string
+	Time time.Time
+	// RemoteAddr is the address of the Listener that registered the Dialer
+	RemoteAddr string
+	// Duration the Dialer was registered, on closed and replaced events
+	Duration time.Duration
+	// Reason the Dialer was closed
+	Reason string
+}
+
+// ConnEvent describes a data connection of a Dialer of the ReversePool.
+type ConnEvent struct {
+	ID   string
+	Time time.Time
+	// Duration the connection was open, on closed events
+	Duration time.Duration
+	// bytes read from and written to the connection, on closed events
+	RxBytes int64
+	TxBytes int64
+	// Reason the connection was closed
+	Reason string
+}
+
+// PoolHooks are callbacks invoked on the lifecycle events of the Dialers of
+// a ReversePool and their data connections, the callbacks not set are
+// ignored. They are invoked synchronously, so they must not block.
+type PoolHooks struct {
+	// OnDialerRegistered is invoked when the first Listener of an id registers.
+	OnDialerRegistered func(DialerEvent)
+	// OnDialerReplaced is invoked, instead of OnDialerRegistered, when a
+	// Listener registers an id whose Dialer is still closing.
+	OnDialerReplaced func(DialerEvent)
+	// OnDialerClosed is invoked when a Dialer is closed.
+	OnDialerClosed func(DialerEvent)
+	// OnConnOpened is invoked when a data connection is handed to a dial.
+	OnConnOpened func(ConnEvent)
+	// OnConnClosed is invoked when a data connection is closed.
+	OnConnClosed func(ConnEvent)
+}
+
+func (h *PoolHooks) dialerRegistered(e DialerEvent) {
+	if h.OnDialerRegistered != nil {
+		h.OnDialerRegistered(e)
+	}
+}
+
+func (h *PoolHooks) dialerReplaced(e DialerEvent) {
+	if h.OnDialerReplaced != nil {
+		h.OnDialerReplaced(e)
+	}
+}
+
+func (h *PoolHooks) dialerClosed(e DialerEvent) {
+	if h.OnDialerClosed != nil {
+		h.OnDialerClosed(e)
+	}
+}
+
+func (h *PoolHooks) connOpened(e ConnEvent) {
+	if h.OnConnOpened != nil {
+		h.OnConnOpened(e)
+	}
+}
+
+func (h *PoolHooks) connClosed(e ConnEvent) {
+	if h.OnConnClosed != nil {
+		h.OnConnClosed(e)
+	}
+}
+
+// ListenerEvent describes a change on the control connection of a Listener.
+type ListenerEvent struct {
+	ID   string
+	Time time.Time
+	// Duration the control connection was established, on disconnected
+	// events, or the time to establish it, on connected events
+	Duration time.Duration
+	// Attempt is the number of the connection attempt that failed, on
+	// reconnecting events
+	Attempt int
+	// Backoff is the time to wait before the next attempt, on reconnecting events
+	Backoff time.Duration
+	// Err is the reason the control connection was lost, on disconnected
+	// events, or the error of the last attempt, on reconnecting events
+	Err error
+}
+
+// ListenerHooks are callbacks invoked on the lifecycle events of the control
+// connection of a Listener, the callbacks not set are ignored. They are
+// invoked synchronously, so they must not block.
+type ListenerHooks struct {
+	// OnConnected is invoked when the control connection is established.
+	OnConnected func(ListenerEvent)
+	// OnDisconnected is invoked when the control connection is lost.
+	OnDisconnected func(ListenerEvent)
+	// OnReconnecting is invoked when an attempt to establish the control
+	// connection fails and it is going to be retried.
+	OnReconnecting func(ListenerEvent)
+}
+
+// WithHooks sets the callbacks invoked on the lifecycle events of the Listener.
+func WithHooks(h ListenerHooks) ListenerOption {
+	return func(ln *Listener) {
+		ln.hooks = h
+	}
+}
+
+func (h *ListenerHooks) connected(e ListenerEvent) {
+	if h.OnConnected != nil {
+		h.OnConnected(e)
+	}
+}
+
+func (h *ListenerHooks) disconnected(e ListenerEvent) {
+	if h.OnDisconnected != nil {
+		h.OnDisconnected(e)
+	}
+}
+
+func (h *ListenerHooks) reconnecting(e ListenerEvent) {
+	if h.OnReconnecting != nil {
+		h.OnReconnecting(e)
+	}
+}
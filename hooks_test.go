@@ -0,0 +1,82 @@
+package h2rev2
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	events := make(chan string, 100)
+	var closedConn ConnEvent
+	var closedDialer DialerEvent
+
+	pool := NewReversePool()
+	pool.Hooks = PoolHooks{
+		OnDialerRegistered: func(e DialerEvent) { events <- "registered " + e.ID },
+		OnDialerReplaced:   func(e DialerEvent) { events <- "replaced " + e.ID },
+		OnDialerClosed: func(e DialerEvent) {
+			closedDialer = e
+			events <- "dialer closed " + e.Reason
+		},
+		OnConnOpened: func(e ConnEvent) { events <- "conn opened " + e.ID },
+		OnConnClosed: func(e ConnEvent) {
+			closedConn = e
+			events <- "conn closed " + e.ID
+		},
+	}
+	var lastReconnect ListenerEvent
+	publicServer, l, stop := setupPool(t, pool, WithHooks(ListenerHooks{
+		OnConnected:    func(e ListenerEvent) { events <- "connected " + e.ID },
+		OnDisconnected: func(e ListenerEvent) { events <- "disconnected " + e.ID },
+		OnReconnecting: func(e ListenerEvent) {
+			lastReconnect = e
+			events <- "reconnecting " + e.ID
+		},
+	}))
+	defer stop()
+	defer serveSlow(l, "l1").Close()
+
+	expect := func(want ...string) {
+		t.Helper()
+		got := map[string]bool{}
+		for range want {
+			select {
+			case e := <-events:
+				got[e] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected events %v, got %v", want, got)
+			}
+		}
+		for _, w := range want {
+			if !got[w] {
+				t.Fatalf("expected events %v, got %v", want, got)
+			}
+		}
+	}
+	expect("registered d001", "connected d001")
+
+	if body, _, err := getBody(publicServer.Client(), publicServer.URL+"/proxy/d001/"); err != nil || body != "l1" {
+		t.Fatalf("unexpected response %q: %v", body, err)
+	}
+	expect("conn opened d001", "conn closed d001")
+	if closedConn.RxBytes == 0 || closedConn.TxBytes == 0 || closedConn.Duration == 0 || closedConn.Reason != ReasonClosed {
+		t.Errorf("unexpected conn closed event %+v", closedConn)
+	}
+
+	// the Listener reconnects after being disconnected
+	pool.DisconnectDialer("d001")
+	expect("dialer closed "+ReasonDisconnected, "disconnected d001", "registered d001", "connected d001")
+	if closedDialer.Duration == 0 {
+		t.Errorf("unexpected dialer closed event %+v", closedDialer)
+	}
+
+	// and keeps trying while the pool rejects it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pool.Shutdown(ctx)
+	expect("dialer closed "+ReasonPoolClosed, "disconnected d001", "reconnecting d001")
+	if lastReconnect.Attempt != 1 || lastReconnect.Err == nil || lastReconnect.Backoff == 0 {
+		t.Errorf("unexpected reconnecting event %+v", lastReconnect)
+	}
+}
@@ -0,0 +1,235 @@
+package h2rev2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// leakCheck returns a function that fails the test if there are more
+// goroutines than when leakCheck was called, once they had time to exit.
+func leakCheck(t *testing.T) func() {
+	t.Helper()
+	base := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		var n int
+		for i := 0; i < 100; i++ {
+			if n = runtime.NumGoroutine(); n <= base {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		buf := new(bytes.Buffer)
+		pprof.Lookup("goroutine").WriteTo(buf, 1)
+		t.Errorf("%d goroutines leaked:\n%s", n-base, buf)
+	}
+}
+
+// churnCount returns n, or less in short mode
+func churnCount(n int) int {
+	if testing.Short() {
+		return n / 10
+	}
+	return n
+}
+
+// serveChurn serves the connections accepted by the Listener, the first
+// byte read selects what to do with the connection:
+// 'c' closes it, 'w' writes until it is closed and any other byte reads
+// until the peer closes it. The byte is echoed before.
+func serveChurn(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			b := make([]byte, 1)
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+			switch b[0] {
+			case 'c':
+			case 'w':
+				buf := make([]byte, 64*1024)
+				for {
+					if _, err := c.Write(buf); err != nil {
+						return
+					}
+				}
+			default:
+				io.Copy(ioutil.Discard, c)
+			}
+		}()
+	}
+}
+
+// countListener counts the connections accepted by the Listener
+type countListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.accepted, 1)
+	}
+	return c, err
+}
+
+// churnConn dials a connection and runs the mode of serveChurn on it.
+func churnConn(ctx context.Context, d *Dialer, mode byte) error {
+	c, err := d.Dial(ctx, "tcp", "d001:80")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Write([]byte{mode}); err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if b[0] != mode {
+		return fmt.Errorf("expected %q, got %q", mode, b[0])
+	}
+	if mode == 'c' {
+		// the Listener closed the connection
+		if _, err := io.Copy(ioutil.Discard, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestLeakConns churns connections over a tunnel, closed by each side, with
+// data not read and with dials that give up, and checks that their
+// goroutines exit, and that the Listener does not accept connections for the
+// dials that gave up.
+func TestLeakConns(t *testing.T) {
+	check := leakCheck(t)
+	defer check()
+
+	// the dials take the idle connections parked, without them the dials
+	// that give up are abandoned while the connection is picked up
+	for _, idle := range []int{0, 2} {
+		t.Run(fmt.Sprintf("idle=%d", idle), func(t *testing.T) {
+			pool := NewReversePool()
+			_, l, stop := setupPool(t, pool, WithIdleConns(idle))
+			defer stop()
+			cl := &countListener{Listener: l}
+			go serveChurn(cl)
+			d := pool.GetDialer("d001")
+
+			var dialed int64
+			modes := []byte{'c', 'e', 'w'}
+			for i := 0; i < churnCount(2000); i++ {
+				if i%4 == 3 {
+					// the dial gives up while the connection is picked up
+					ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%16)*100*time.Microsecond)
+					c, err := d.Dial(ctx, "tcp", "d001:80")
+					cancel()
+					if err == nil {
+						dialed++
+						c.Close()
+					}
+					continue
+				}
+				dialed++
+				if err := churnConn(context.Background(), d, modes[i%4]); err != nil {
+					t.Fatalf("connection %d: %v", i, err)
+				}
+			}
+			// the connections of the dials that gave up are not accepted
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt64(&cl.accepted) < dialed && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(200 * time.Millisecond)
+			if accepted := atomic.LoadInt64(&cl.accepted); accepted != dialed {
+				t.Errorf("expected %d connections accepted, got %d", dialed, accepted)
+			}
+		})
+	}
+}
+
+// TestLeakTunnels churns tunnels with connections open, accepted, forwarded
+// or not accepted, closed by the Listener or by the pool, and checks that
+// their goroutines exit.
+func TestLeakTunnels(t *testing.T) {
+	check := leakCheck(t)
+	defer check()
+
+	echoAddr, stopEcho := echoServer(t)
+	defer stopEcho()
+	port := addrPort(t, echoAddr)
+
+	for i := 0; i < churnCount(1000); i++ {
+		opts := []ListenerOption{WithTCPTargets(echoAddr)}
+		if i%2 == 0 {
+			opts = append(opts, WithIdleConns(1))
+		}
+		pool := NewReversePool()
+		_, l, stop := setupPool(t, pool, opts...)
+		d := pool.GetDialer("d001")
+		if i%3 == 0 {
+			go serveChurn(l)
+			if err := churnConn(context.Background(), d, 'e'); err != nil {
+				t.Fatalf("tunnel %d: %v", i, err)
+			}
+		}
+		// connections left open, they are not accepted by the Listener
+		// unless it is serving
+		var conns []net.Conn
+		for j := 0; j < 2; j++ {
+			c, err := d.Dial(context.Background(), "tcp", "d001:80")
+			if err != nil {
+				t.Fatalf("tunnel %d: %v", i, err)
+			}
+			conns = append(conns, c)
+		}
+		// connection forwarded to the echo server, as the CONNECT requests
+		fc, err := d.dial(context.Background(), dialTarget{network: "tcp", address: "d001:" + port, portForward: true})
+		if err != nil {
+			t.Fatalf("tunnel %d: %v", i, err)
+		}
+		fc.SetDeadline(time.Now().Add(10 * time.Second))
+		msg := []byte("hello tunnel\n")
+		if _, err := fc.Write(msg); err != nil {
+			t.Fatalf("tunnel %d: %v", i, err)
+		}
+		echo := make([]byte, len(msg))
+		if _, err := io.ReadFull(fc, echo); err != nil || !bytes.Equal(echo, msg) {
+			t.Fatalf("tunnel %d: unexpected echo %q: %v", i, echo, err)
+		}
+		if i%4 == 0 {
+			d.Close()
+		}
+		l.Close()
+		// the Listener closes the connections it forwards
+		if _, err := io.Copy(ioutil.Discard, fc); err != nil {
+			t.Fatalf("tunnel %d: forwarded connection not closed: %v", i, err)
+		}
+		fc.Close()
+		for _, c := range conns {
+			c.Close()
+		}
+		stop()
+	}
+}
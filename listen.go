@@ -4,6 +4,7 @@ package h2rev2
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,28 +18,176 @@ import (
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/http2"
 	"k8s.io/klog/v2"
 )
 
 var _ net.Listener = (*Listener)(nil)
 
+const (
+	// number of attempts to create the control connection on NewListener
+	initialDialAttempts = 5
+	// bounds of the backoff used to re-establish the control connection
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 30 * time.Second
+	// time the control connection has to stay up to reset the backoff
+	minHealthyConnection = 10 * time.Second
+)
+
 // Listener is a net.Listener, returning new connections which arrive
 // from a corresponding Dialer.
+// The Listener supervises the control connection with the Dialer, and
+// re-establishes it if it fails, until the Listener is closed or the
+// Dialer rejects it permanently.
 type Listener struct {
 	// Request for the reverse connection with format
 	// https://host:port/path/revdial?id=<id>
-	url    string
-	client *http.Client
+	url        string
+	id         string
+	client     *http.Client
+	urlOptions URLOptions
 
-	sc     net.Conn // control plane connection
 	connc  chan net.Conn
 	donec  chan struct{}
-	writec chan<- []byte
+	drainc chan struct{} // closed when the Listener is shutting down
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// modify the requests to the Dialer, per example, to add credentials
+	requestEditors []func(*http.Request) error
+	metrics        metrics
+	hooks          ListenerHooks
+	tracer         trace.Tracer
+
+	// TCP ports to expose on the public host and targets allowed to forward to
+	tcpExposures []tcpExposureRequest
+	tcpTargets   []string
 
-	mu      sync.Mutex // guards below, closing connc, and writing to rw
-	readErr error
+	// number of idle connections parked in the Dialer
+	idleConns int
+	// software version announced to the Dialer
+	agentVersion string
+
+	// dial the addresses requested to the Dialer, if allowed
+	egress          bool
+	egressAllowlist []string
+	// version of the PROXY protocol header sent to the forwarded connections
+	proxyProtocol int
+	// timeouts of the data connections
+	connIdleTimeout time.Duration
+	connMaxLifetime time.Duration
+
+	mu      sync.Mutex   // guards below
+	sc      *controlConn // current control plane connection
+	readErr error        // permanent error that closed the Listener
 	closed  bool
+	conns   int              // data connections active
+	byID    map[string]*conn // data connections open, by id
+	// offsets where the Dialer ended the writes of connections that were
+	// not open yet, the control connection can be faster than the dial
+	readEnds map[string]int64
+}
+
+// ListenerOption configures a Listener.
+type ListenerOption func(*Listener)
+
+// WithRequestEditor adds a function that modifies all the requests sent to
+// the Dialer, per example, to attach credentials. An error aborts the request.
+func WithRequestEditor(fn func(*http.Request) error) ListenerOption {
+	return func(ln *Listener) {
+		ln.requestEditors = append(ln.requestEditors, fn)
+	}
+}
+
+// WithBearerToken adds an Authorization Bearer header with the token to all
+// the requests sent to the Dialer.
+func WithBearerToken(token string) ListenerOption {
+	return WithRequestEditor(func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})
+}
+
+// WithMetrics records the metrics of the Listener and its connections.
+func WithMetrics(m Metrics) ListenerOption {
+	return func(ln *Listener) {
+		ln.metrics = metrics{m}
+	}
+}
+
+// tcpExposureRequest is a TCP port the Listener requests to expose on the public host
+type tcpExposureRequest struct {
+	addr   string
+	target string
+}
+
+// WithTCPExposure requests the Dialer to listen on the TCP address addr of the
+// public host, the connections accepted are forwarded by the Listener to the
+// target host:port. The request is repeated each time the control connection
+// is established, the ReversePool must allow it.
+func WithTCPExposure(addr string, target string) ListenerOption {
+	return func(ln *Listener) {
+		ln.tcpExposures = append(ln.tcpExposures, tcpExposureRequest{addr: addr, target: target})
+		ln.tcpTargets = append(ln.tcpTargets, target)
+	}
+}
+
+// WithURLOptions sets the names used on the URLs of the ReversePool, they
+// must match the URLOptions of the ReversePool.
+func WithURLOptions(opts URLOptions) ListenerOption {
+	return func(ln *Listener) {
+		ln.urlOptions = opts
+	}
+}
+
+// WithTCPTargets allows the Dialer to forward connections to the target
+// host:port, per example, the ones exposed with ReversePool.ExposeTCP.
+// The CONNECT requests to the ReversePool for the port of a target are also
+// forwarded to it.
+func WithTCPTargets(targets ...string) ListenerOption {
+	return func(ln *Listener) {
+		ln.tcpTargets = append(ln.tcpTargets, targets...)
+	}
+}
+
+// WithIdleConns keeps n idle connections parked in the Dialer, so new
+// connections are served immediately, without waiting for the Listener to
+// pick them up. The idle connections are replenished as they are consumed.
+func WithIdleConns(n int) ListenerOption {
+	return func(ln *Listener) {
+		ln.idleConns = n
+	}
+}
+
+// WithTracerProvider traces the data connections, continuing the traces
+// of the ReversePool. The trace context is available on the accepted
+// connections with MetadataFromConn.
+func WithTracerProvider(tp trace.TracerProvider) ListenerOption {
+	return func(ln *Listener) {
+		ln.tracer = newTracer(tp)
+	}
+}
+
+// WithAgentVersion sets the software version announced to the Dialer in
+// the handshake.
+func WithAgentVersion(version string) ListenerOption {
+	return func(ln *Listener) {
+		ln.agentVersion = version
+	}
+}
+
+// WithEgressGateway makes the Listener dial the address requested on
+// Dialer.Dial and forward the connection to it, instead of returning it on
+// Accept, so the Dialer can reach any host of the internal network.
+// The allowlist restricts the addresses, the entries can be a host:port,
+// a host or a CIDR, an empty allowlist allows any address.
+func WithEgressGateway(allowlist ...string) ListenerOption {
+	return func(ln *Listener) {
+		ln.egress = true
+		ln.egressAllowlist = append(ln.egressAllowlist, allowlist...)
+	}
 }
 
 // NewListener returns a new Listener, it dials to the Dialer
@@ -46,144 +195,614 @@ type Listener struct {
 // - client: http client, required for TLS
 // - host: a URL to the base of the reverse handler on the Dialer
 // - id: identify this listener
-func NewListener(client *http.Client, host string, id string) (*Listener, error) {
+// - opts: optional configuration of the Listener
+func NewListener(client *http.Client, host string, id string, opts ...ListenerOption) (*Listener, error) {
 	err := configureHTTP2Transport(client)
 	if err != nil {
 		return nil, err
 	}
 
-	url, err := serverURL(host, id)
+	ln := &Listener{
+		id:         id,
+		client:     client,
+		connc:      make(chan net.Conn, 4), // arbitrary
+		donec:      make(chan struct{}),
+		drainc:     make(chan struct{}),
+		minBackoff: minReconnectBackoff,
+		maxBackoff: maxReconnectBackoff,
+	}
+	for _, opt := range opts {
+		opt(ln)
+	}
+	ln.url, err = serverURL(host, id, ln.urlOptions)
 	if err != nil {
 		return nil, err
 	}
-
-	ln := &Listener{
-		url:    url,
-		client: client,
-		connc:  make(chan net.Conn, 4), // arbitrary
-		donec:  make(chan struct{}),
+	if ln.tracer == nil {
+		ln.tracer = newTracer(nil)
+	}
+	if ln.proxyProtocol < 0 || ln.proxyProtocol > 2 {
+		return nil, fmt.Errorf("PROXY protocol version %d not supported", ln.proxyProtocol)
 	}
 
 	// create control plane connection
-	// poor man backoff retry
-	sleep := 1 * time.Second
-	var c net.Conn
-	for attempts := 5; attempts > 0; attempts-- {
-		c, err = ln.dial()
-		if err != nil {
-			klog.V(5).Infof("Can not create control connection %v", err)
-			// Add some randomness to prevent creating a Thundering Herd
-			jitter := time.Duration(rand.Int63n(int64(sleep)))
-			sleep = 2*sleep + jitter/2
-			time.Sleep(sleep)
-		} else {
-			ln.sc = c
-			break
-		}
-	}
-	if c == nil || err != nil {
+	start := time.Now()
+	sc, err := ln.connect(initialDialAttempts, newBackoff(ln.minBackoff, ln.maxBackoff))
+	if err != nil {
 		return nil, err
 	}
+	ln.sc = sc
+	ln.metrics.listenerConnectionUp(ln.id, false)
+	ln.hooks.connected(ListenerEvent{ID: ln.id, Time: sc.connected, Duration: sc.connected.Sub(start)})
 
 	go ln.run()
 	return ln, nil
 }
 
-// run establish reverse connections against the server
+// connect creates a new control plane connection, retrying with the jittered
+// exponential backoff b. It gives up after the number of attempts, if positive,
+// if the error is permanent or if the Listener is closed.
+func (ln *Listener) connect(attempts int, b *backoff) (*controlConn, error) {
+	for i := 1; ; i++ {
+		sid := newPickupToken()
+		c, err := ln.dial(context.Background(), url.Values{urlParamSession: {sid}})
+		if err == nil {
+			return newControlConn(c, sid), nil
+		}
+		if isPermanentError(err) {
+			klog.V(2).Infof("Control connection rejected: %v", err)
+			return nil, err
+		}
+		if attempts > 0 && i >= attempts {
+			return nil, err
+		}
+		klog.V(5).Infof("Can not create control connection, attempt %d: %v", i, err)
+		delay := b.next()
+		ln.hooks.reconnecting(ListenerEvent{ID: ln.id, Time: time.Now(), Attempt: i, Backoff: delay, Err: err})
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ln.donec:
+			t.Stop()
+			return nil, ErrListenerClosed
+		}
+	}
+}
+
+// run supervises the control connection, re-establishing it when it fails.
+// It only returns when the Listener is closed or the reconnection fails
+// with a permanent error.
 func (ln *Listener) run() {
-	defer ln.Close()
+	// the backoff is kept across the control connections, so the ones
+	// dropped once accepted are not re-established in a tight loop
+	b := newBackoff(ln.minBackoff, ln.maxBackoff)
+	for {
+		ln.mu.Lock()
+		sc := ln.sc
+		ln.mu.Unlock()
+
+		err := ln.serve(sc)
+		ln.metrics.listenerConnectionDown(ln.id)
+		now := time.Now()
+		if isClosedChan(ln.donec) {
+			err = ErrListenerClosed
+		}
+		ln.hooks.disconnected(ListenerEvent{ID: ln.id, Time: now, Duration: now.Sub(sc.connected), Err: err})
+		select {
+		case <-ln.donec:
+			return
+		case <-ln.drainc:
+			// Shutdown closes the Listener once the connections are done
+			return
+		default:
+		}
+		if isPermanentError(err) {
+			log.Printf("revdial.Listener: control connection rejected: %v", err)
+			ln.closeWithError(err)
+			return
+		}
+		klog.V(2).Infof("revdial.Listener: control connection lost, reconnecting: %v", err)
+
+		if now.Sub(sc.connected) >= minHealthyConnection {
+			b = newBackoff(ln.minBackoff, ln.maxBackoff)
+		}
+		// wait even after a healthy connection, the jitter spreads the
+		// reconnections of the Listeners when the public server restarts
+		if !ln.wait(b.next()) {
+			return
+		}
+		sc, err = ln.connect(0, b)
+		if err != nil {
+			ln.closeWithError(err)
+			return
+		}
+		ln.mu.Lock()
+		if ln.closed || isClosedChan(ln.drainc) {
+			ln.mu.Unlock()
+			sc.Close()
+			return
+		}
+		ln.sc = sc
+		ln.mu.Unlock()
+		ln.metrics.listenerConnectionUp(ln.id, true)
+		ln.hooks.connected(ListenerEvent{ID: ln.id, Time: sc.connected, Duration: sc.connected.Sub(now)})
+	}
+}
+
+// wait waits for the delay, it returns false if the Listener is closed or
+// shutting down meanwhile.
+func (ln *Listener) wait(delay time.Duration) bool {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ln.donec:
+		return false
+	case <-ln.drainc:
+		return false
+	}
+}
+
+// serve processes the messages received on the control connection and
+// returns when the connection fails.
+func (ln *Listener) serve(sc *controlConn) error {
+	defer sc.Close()
 
 	// Write loop
-	writec := make(chan []byte, 8)
-	ln.writec = writec
 	go func() {
 		for {
 			select {
-			case <-ln.donec:
+			case <-sc.donec:
 				return
-			case msg := <-writec:
-				if _, err := ln.sc.Write(msg); err != nil {
+			case msg := <-sc.writec:
+				if _, err := sc.Write(msg); err != nil {
 					log.Printf("revdial.Listener: error writing message to server: %v", err)
-					ln.Close()
+					sc.Close()
 					return
 				}
 			}
 		}
 	}()
 
+	// the features are enabled once they are negotiated in the handshake
+	sc.sendMessage(controlMsg{
+		Command:      "hello",
+		Version:      ProtocolVersion,
+		Agent:        ln.agentVersion,
+		Capabilities: supportedCapabilities,
+	})
+
 	// Read loop
-	br := bufio.NewReader(ln.sc)
+	br := bufio.NewReader(sc)
 	for {
 		line, err := br.ReadSlice('\n')
 		if err != nil {
-			return
+			return err
 		}
 		var msg controlMsg
 		if err := json.Unmarshal(line, &msg); err != nil {
 			log.Printf("revdial.Listener read invalid JSON: %q: %v", line, err)
-			return
+			return err
 		}
 		switch msg.Command {
 		case "keep-alive":
 			// Occasional no-op message from server to keep
 			// us alive through NAT timeouts.
+		case "hello-ack":
+			if msg.Err != "" {
+				return fmt.Errorf("%w: %s", ErrIncompatiblePeer, msg.Err)
+			}
+			klog.V(5).Infof("revdial.Listener: Dialer %s protocol version %d capabilities %v", msg.Agent, msg.Version, msg.Capabilities)
+			ln.startFeatures(sc, msg.Capabilities)
 		case "conn-ready":
-			go ln.grabConn()
+			go ln.grabConn(sc, msg)
+		case "conn-close-write":
+			ln.endRead(msg.ConnPath, msg.Offset)
+		case "expose-tcp-result":
+			if msg.Err != "" {
+				log.Printf("revdial.Listener: error exposing %s: %v", msg.Address, msg.Err)
+			} else {
+				klog.V(2).Infof("revdial.Listener: exposed %s forwarding to %s", msg.Address, msg.Forward)
+			}
 		default:
 			// Ignore unknown messages
 		}
 	}
 }
 
-func (ln *Listener) sendMessage(m controlMsg) {
+// startFeatures enables the features negotiated with the Dialer.
+func (ln *Listener) startFeatures(sc *controlConn, capabilities []string) {
+	if strSliceContains(capabilities, CapabilityTCPExpose) {
+		for _, e := range ln.tcpExposures {
+			sc.sendMessage(controlMsg{Command: "expose-tcp", Address: e.addr, Forward: e.target})
+		}
+	} else if len(ln.tcpExposures) > 0 {
+		log.Printf("revdial.Listener: Dialer does not support exposing TCP ports")
+	}
+	if strSliceContains(capabilities, CapabilityIdleConns) {
+		for i := 0; i < ln.idleConns; i++ {
+			go ln.keepIdleConn(sc)
+		}
+	}
+}
+
+// controlConn is a control plane connection with the Dialer.
+type controlConn struct {
+	net.Conn
+	sid       string // identifies the control connection in the Dialer
+	connected time.Time
+	writec    chan []byte
+	donec     chan struct{}
+	closeOnce sync.Once
+}
+
+func newControlConn(c net.Conn, sid string) *controlConn {
+	return &controlConn{
+		Conn:      c,
+		sid:       sid,
+		connected: time.Now(),
+		writec:    make(chan []byte, 8),
+		donec:     make(chan struct{}),
+	}
+}
+
+// sendMessage queues a message to be written by the write loop, messages
+// are dropped if the control connection is closed.
+func (sc *controlConn) sendMessage(m controlMsg) {
 	j, _ := json.Marshal(m)
 	j = append(j, '\n')
-	ln.writec <- j
+	select {
+	case sc.writec <- j:
+	case <-sc.donec:
+	}
+}
+
+func (sc *controlConn) Close() error {
+	sc.closeOnce.Do(func() {
+		sc.Conn.Close()
+		close(sc.donec)
+	})
+	return nil
 }
 
-func (ln *Listener) dial() (*conn, error) {
+// dial creates a new connection to the Dialer, the params identify the
+// type of connection. It returns once the Dialer sends the response headers.
+func (ln *Listener) dial(ctx context.Context, params url.Values) (*conn, error) {
+	u := ln.url
+	if len(params) > 0 {
+		u += "&" + params.Encode()
+	}
 	pr, pw := io.Pipe()
-	req, err := http.NewRequest("GET", ln.url, pr)
+	body := &requestBody{ReadCloser: pr, done: make(chan struct{})}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, body)
 	if err != nil {
 		klog.V(5).Infof("Can not create request %v", err)
 		return nil, err
 	}
+	for _, fn := range ln.requestEditors {
+		if err := fn(req); err != nil {
+			return nil, err
+		}
+	}
 
 	klog.V(5).Infof("Listener creating connection to %s", ln.url)
 	res, err := ln.client.Do(req)
 	if err != nil {
-		klog.V(5).Infof("Can not connect to %s request %v, retry %d", ln.url, err)
+		klog.V(5).Infof("Can not connect to %s request %v", ln.url, err)
 		return nil, err
 	}
 	if res.StatusCode != 200 {
-		klog.V(5).Infof("Status code %d on request %v, retry %d", res.StatusCode, ln.url)
-		return nil, fmt.Errorf("status code %d", res.StatusCode)
+		klog.V(5).Infof("Status code %d on request %v", res.StatusCode, ln.url)
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode}
 	}
 
 	c := newConn(res.Body, pw)
+	// the writes are sent once the transport reads the end of the request
+	c.setWriteSent(body.done)
+	c.trailerReason(res)
+	// ending the request ends the writes
+	c.setCloseWrite(func(int64) error { return pw.Close() })
+	if id := res.Header.Get(headerConnID); id != "" {
+		c.id = id
+		c.closePeer = ln.closePeer(id)
+		ln.trackConn(c)
+	}
+	c.localAddr = ln.Addr()
+	c.setMetadata(metadataFromHeader(res.Header))
 	return c, nil
 }
 
-func (ln *Listener) grabConn() {
+// requestBody is the body of the requests of the data connections, done is
+// closed once the transport reads the end of the body or closes it, the
+// data read before is sent then.
+type requestBody struct {
+	io.ReadCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.end()
+	}
+	return n, err
+}
+
+func (b *requestBody) Close() error {
+	b.end()
+	return b.ReadCloser.Close()
+}
+
+func (b *requestBody) end() {
+	b.once.Do(func() { close(b.done) })
+}
+
+// trackConn keeps the data connection c until it is closed, so the Dialer
+// can refer to it by its id.
+func (ln *Listener) trackConn(c *conn) {
+	ln.mu.Lock()
+	if ln.byID == nil {
+		ln.byID = map[string]*conn{}
+	}
+	ln.byID[c.id] = c
+	offset, ended := ln.readEnds[c.id]
+	delete(ln.readEnds, c.id)
+	ln.mu.Unlock()
+	if ended {
+		c.endRead(offset)
+	}
+	go func() {
+		<-c.Done()
+		ln.mu.Lock()
+		delete(ln.byID, c.id)
+		ln.mu.Unlock()
+	}()
+}
+
+// endRead ends the reads of the data connection with the id once it reads
+// the offset, the Dialer ended its writes there.
+func (ln *Listener) endRead(id string, offset int64) {
+	ln.mu.Lock()
+	c, ok := ln.byID[id]
+	if !ok {
+		if ln.readEnds == nil {
+			ln.readEnds = map[string]int64{}
+		}
+		ln.readEnds[id] = offset
+	}
+	ln.mu.Unlock()
+	if ok {
+		c.endRead(offset)
+	}
+}
+
+// closePeer returns a function that asks the pool to close the data
+// connection with the id, it returns false if there is no control
+// connection to ask.
+func (ln *Listener) closePeer(id string) func(reason string) bool {
+	return func(reason string) bool {
+		ln.mu.Lock()
+		sc := ln.sc
+		ln.mu.Unlock()
+		if sc == nil || isClosedChan(sc.donec) {
+			return false
+		}
+		sc.sendMessage(controlMsg{Command: "conn-close", ConnPath: id, Err: reason})
+		return true
+	}
+}
+
+func (ln *Listener) grabConn(sc *controlConn, msg controlMsg) {
+	if !ln.connStarted(true) {
+		sc.sendMessage(controlMsg{Command: "pickup-failed", ConnPath: msg.ConnPath, Err: "listener draining"})
+		return
+	}
+	defer ln.connDone()
+	forward := msg.Forward
+	if forward == "" && msg.PortForward {
+		forward = ln.portTarget(msg.Address)
+	}
+	meta, span := ln.startConnSpan(Metadata{
+		Network:      msg.Network,
+		Address:      msg.Address,
+		RemoteAddr:   msg.RemoteAddr,
+		Host:         msg.Host,
+		TraceContext: msg.Trace,
+		portForward:  msg.PortForward,
+	}, forward)
+	// connections to be forwarded do not go through Accept
+	var fc net.Conn
+	var err error
+	defer func() { endSpan(span, err) }()
+	switch {
+	case forward != "":
+		fc, err = ln.dialForward(forward)
+	case ln.egress:
+		fc, err = ln.dialEgress(meta)
+	}
+	if err != nil {
+		klog.V(5).Infof("Can not forward connection: %v", err)
+		sc.sendMessage(controlMsg{Command: "pickup-failed", ConnPath: msg.ConnPath, Err: err.Error()})
+		return
+	}
+
 	// create a new connection
-	c, err := ln.dial()
+	c, err := ln.dial(context.Background(), url.Values{urlParamConn: {msg.ConnPath}})
 	if err != nil {
 		klog.V(5).Infof("Can not create connection %v", err)
-		ln.sendMessage(controlMsg{Command: "pickup-failed", ConnPath: "", Err: err.Error()})
+		if fc != nil {
+			fc.Close()
+		}
+		sc.sendMessage(controlMsg{Command: "pickup-failed", ConnPath: msg.ConnPath, Err: err.Error()})
+		return
+	}
+	c.setMetadata(meta)
+	c.setTimeouts(ln.connIdleTimeout, ln.connMaxLifetime)
+	if fc != nil {
+		defer c.Close()
+		if err = ln.sendProxyHeader(fc, c); err != nil {
+			fc.Close()
+			return
+		}
+		ln.forward(c, fc)
+		return
+	}
+	ln.serveConn(c)
+}
+
+// keepIdleConn keeps an idle connection parked in the Dialer, replacing it
+// once it is consumed, until the control connection is closed.
+func (ln *Listener) keepIdleConn(sc *controlConn) {
+	closed := func() bool {
+		return isClosedChan(sc.donec) || isClosedChan(ln.donec)
+	}
+	b := newBackoff(ln.minBackoff, ln.maxBackoff)
+	for {
+		// the Dialer rejects the parked connections once the Listener is draining
+		if isClosedChan(ln.drainc) || closed() {
+			return
+		}
+		// blocks until the Dialer picks up the connection
+		c, err := ln.dialIdle(sc)
+		if err != nil {
+			if closed() {
+				return
+			}
+			klog.V(5).Infof("Can not create idle connection %v", err)
+			if isPermanentError(err) {
+				return
+			}
+			t := time.NewTimer(b.next())
+			select {
+			case <-t.C:
+			case <-ln.drainc:
+				t.Stop()
+				return
+			case <-sc.donec:
+				t.Stop()
+				return
+			case <-ln.donec:
+				t.Stop()
+				return
+			}
+			continue
+		}
+		b = newBackoff(ln.minBackoff, ln.maxBackoff)
+		go ln.serveIdleConn(c)
+	}
+}
+
+// dialIdle parks a connection in the Dialer and returns it once a dial picks
+// it up. The request is cancelled if the control connection or the Listener
+// are closed while it is parked, but not once it is picked up, the
+// connection outlives them as the ones requested by the Dialer.
+func (ln *Listener) dialIdle(sc *controlConn) (*conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	parked := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-sc.donec:
+		case <-ln.donec:
+		case <-parked:
+			return
+		}
+		cancel()
+	}()
+	c, err := ln.dial(ctx, url.Values{urlParamSession: {sc.sid}, urlParamIdle: {"true"}})
+	close(parked)
+	<-watched
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// cancelled while the response headers were received
+	if ctx.Err() != nil {
+		c.Close()
+		return nil, ctx.Err()
+	}
+	return c, nil
+}
+
+// serveIdleConn handles an idle connection once it is picked up.
+func (ln *Listener) serveIdleConn(c *conn) {
+	// the Dialer already handed the connection to a dial
+	ln.connStarted(false)
+	defer ln.connDone()
+	var span trace.Span
+	var meta Metadata
+	var forward string
+	if c.meta.portForward {
+		forward = ln.portTarget(c.meta.Address)
+	}
+	meta, span = ln.startConnSpan(c.meta, forward)
+	c.setMetadata(meta)
+	c.setTimeouts(ln.connIdleTimeout, ln.connMaxLifetime)
+	var err error
+	defer func() { endSpan(span, err) }()
+	if !ln.egress && forward == "" {
+		ln.serveConn(c)
 		return
 	}
 	defer c.Close()
+	var fc net.Conn
+	if forward != "" {
+		fc, err = ln.dialForward(forward)
+	} else {
+		fc, err = ln.dialEgress(c.meta)
+	}
+	if err != nil {
+		klog.V(5).Infof("Can not forward connection: %v", err)
+		return
+	}
+	if err = ln.sendProxyHeader(fc, c); err != nil {
+		fc.Close()
+		return
+	}
+	ln.forward(c, fc)
+}
+
+// forward pipes the data connection c with the connection fc until one of
+// them is closed, they are closed with the Listener as the accepted ones.
+func (ln *Listener) forward(c *conn, fc net.Conn) {
+	ln.metrics.trackConn(c, ln.id, sideListener)
+	go func() {
+		select {
+		case <-c.Done():
+		case <-ln.donec:
+			c.Close()
+		}
+	}()
+	pipe(c, fc)
+}
+
+// startConnSpan starts the span of a data connection, continuing the trace
+// of the dial, and returns the metadata with the trace context of the span.
+func (ln *Listener) startConnSpan(meta Metadata, forward string) (Metadata, trace.Span) {
+	ctx := extractTrace(context.Background(), meta.TraceContext)
+	ctx, span := ln.tracer.Start(ctx, spanListenerConn,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrID.String(ln.id), attrNetwork.String(meta.Network), attrAddress.String(meta.Address), attrForward.String(forward)),
+	)
+	meta.ID = ln.id
+	meta.TraceContext = injectTrace(ctx)
+	return meta, span
+}
+
+// serveConn hands the connection to Accept and holds it until it is closed.
+func (ln *Listener) serveConn(c *conn) {
+	defer c.Close()
+	ln.metrics.trackConn(c, ln.id, sideListener)
 
 	// send the connection to the listener
 	select {
+	case ln.connc <- c:
 	case <-ln.donec:
 		return
-	default:
-		select {
-		case ln.connc <- c:
-		case <-ln.donec:
-			return
-		}
 	}
 
 	// hold the connection open until it closes
@@ -194,20 +813,154 @@ func (ln *Listener) grabConn() {
 	}
 }
 
+// connStarted accounts an active data connection, new connections are
+// rejected once the Listener is draining, the ones already picked up are not.
+func (ln *Listener) connStarted(isNew bool) bool {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if isNew && isClosedChan(ln.drainc) {
+		return false
+	}
+	ln.conns++
+	return true
+}
+
+func (ln *Listener) connDone() {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.conns--
+}
+
+// sendProxyHeader writes the PROXY protocol header, if configured, to the
+// connection fc that forwards the data connection c.
+func (ln *Listener) sendProxyHeader(fc net.Conn, c *conn) error {
+	if ln.proxyProtocol == 0 {
+		return nil
+	}
+	return WriteProxyHeader(fc, ln.proxyProtocol, c.RemoteAddr(), fc.RemoteAddr())
+}
+
+// dialForward connects to the target if it is allowed.
+func (ln *Listener) dialForward(target string) (net.Conn, error) {
+	if !strSliceContains(ln.tcpTargets, target) {
+		return nil, fmt.Errorf("forwarding to %s not allowed", target)
+	}
+	return net.DialTimeout("tcp", target, tcpDialTimeout)
+}
+
+// portTarget returns the TCP target allowed with the port of the address if
+// the host is the id of the Listener, as the CONNECT requests to the
+// ReversePool only carry the port of the service. It is only used for the
+// connections the ReversePool requests as port forwards.
+func (ln *Listener) portTarget(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host != ln.id {
+		return ""
+	}
+	for _, target := range ln.tcpTargets {
+		if _, p, err := net.SplitHostPort(target); err == nil && p == port {
+			return target
+		}
+	}
+	return ""
+}
+
+// dialEgress connects to the address requested to the Dialer if it is allowed.
+func (ln *Listener) dialEgress(meta Metadata) (net.Conn, error) {
+	network := meta.Network
+	if network == "" {
+		network = "tcp"
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s not supported", network)
+	}
+	if meta.Address == "" {
+		return nil, fmt.Errorf("no address requested")
+	}
+	if !addressAllowed(ln.egressAllowlist, meta.Address) {
+		return nil, fmt.Errorf("dialing %s not allowed", meta.Address)
+	}
+	return net.DialTimeout(network, meta.Address, tcpDialTimeout)
+}
+
+// addressAllowed returns true if the address matches one of the entries of
+// the allowlist, that can be a host:port, a host or a CIDR. An empty allowlist
+// allows any address.
+func addressAllowed(allowlist []string, address string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	for _, a := range allowlist {
+		if a == address || a == host {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(a); err == nil && ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Accept blocks and returns a new connection, or an error.
+// Accept keeps blocking while the control connection is being
+// re-established, it only fails after the Listener is closed.
 func (ln *Listener) Accept() (net.Conn, error) {
-	c, ok := <-ln.connc
-	if !ok {
+	select {
+	case c := <-ln.connc:
+		klog.V(5).Infof("Accept connection")
+		return c, nil
+	case <-ln.donec:
+	}
+	ln.mu.Lock()
+	err := ln.readErr
+	ln.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("revdial: Listener closed; %w", err)
+	}
+	return nil, ErrListenerClosed
+}
+
+// Shutdown gracefully shuts down the Listener, it tells the Dialer to stop
+// requesting new connections and waits for the active ones to be closed
+// before closing the Listener. If the context expires first, the Listener
+// is closed and the context error is returned.
+func (ln *Listener) Shutdown(ctx context.Context) error {
+	ln.mu.Lock()
+	if ln.closed {
+		ln.mu.Unlock()
+		return nil
+	}
+	if !isClosedChan(ln.drainc) {
+		close(ln.drainc)
+		// sent before any pickup failure caused by the drain, Dialers
+		// not supporting it ignore the message
+		ln.sc.sendMessage(controlMsg{Command: "drain"})
+	}
+	ln.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
 		ln.mu.Lock()
-		err, closed := ln.readErr, ln.closed
+		conns := ln.conns
 		ln.mu.Unlock()
-		if err != nil && !closed {
-			return nil, fmt.Errorf("revdial: Listener closed; %w", err)
+		if conns == 0 {
+			return ln.Close()
+		}
+		select {
+		case <-ctx.Done():
+			ln.Close()
+			return ctx.Err()
+		case <-ticker.C:
 		}
-		return nil, ErrListenerClosed
 	}
-	klog.V(5).Infof("Accept connection")
-	return c, nil
 }
 
 // ErrListenerClosed is returned by Accept after Close has been called.
@@ -216,21 +969,26 @@ var ErrListenerClosed = errors.New("revdial: Listener closed")
 // Close closes the Listener, making future Accept calls return an
 // error.
 func (ln *Listener) Close() error {
+	return ln.closeWithError(nil)
+}
+
+// closeWithError closes the Listener, Accept will return err if not nil.
+func (ln *Listener) closeWithError(err error) error {
 	ln.mu.Lock()
 	defer ln.mu.Unlock()
 	if ln.closed {
 		return nil
 	}
 	ln.closed = true
-	close(ln.connc)
+	ln.readErr = err
 	close(ln.donec)
 	ln.sc.Close()
 	return nil
 }
 
-// Addr returns a dummy address. This exists only to conform to the
-// net.Listener interface.
-func (ln *Listener) Addr() net.Addr { return connAddr{} }
+// Addr returns the address of the Listener, with its id and the URL of
+// the Dialer.
+func (ln *Listener) Addr() net.Addr { return &Addr{ID: ln.id, URL: ln.url} }
 
 // configureHTTP2Transport enable ping to avoid issues with stale connections
 func configureHTTP2Transport(client *http.Client) error {
@@ -261,6 +1019,48 @@ func configureHTTP2Transport(client *http.Client) error {
 	return nil
 }
 
+// statusError is returned when the Dialer replies with an unexpected status code.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status code %d", e.code)
+}
+
+// isPermanentError returns true if retrying will not succeed, per example,
+// if the Dialer rejected the credentials.
+func isPermanentError(err error) bool {
+	if errors.Is(err, ErrIncompatiblePeer) {
+		return true
+	}
+	var se *statusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.code == http.StatusUnauthorized || se.code == http.StatusForbidden
+}
+
+// backoff returns jittered exponential delays between min and max.
+type backoff struct {
+	cur time.Duration
+	max time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{cur: min, max: max}
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.cur
+	b.cur *= 2
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	// Add some randomness to prevent creating a Thundering Herd
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func strSliceContains(ss []string, s string) bool {
 	for _, v := range ss {
 		if v == s {
@@ -271,7 +1071,7 @@ func strSliceContains(ss []string, s string) bool {
 }
 
 // serverURL builds the destination url with the query parameter
-func serverURL(host string, id string) (string, error) {
+func serverURL(host string, id string, opts URLOptions) (string, error) {
 	if id == "" {
 		return "", fmt.Errorf("id can not be empty")
 	}
@@ -280,5 +1080,5 @@ func serverURL(host string, id string) (string, error) {
 		return "", fmt.Errorf("wrong url format, expected https://host<:port>/<path>: %w", err)
 	}
 	host = strings.Trim(host, "/")
-	return host + "/" + pathRevDial + "?" + urlParamKey + "=" + id, nil
+	return host + "/" + opts.revDialPath() + "?" + opts.idParam() + "=" + url.QueryEscape(id), nil
 }
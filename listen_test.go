@@ -8,6 +8,7 @@ func Test_serverURL(t *testing.T) {
 		name    string
 		host    string
 		id      string
+		opts    URLOptions
 		want    string
 		wantErr bool
 	}{
@@ -17,6 +18,13 @@ func Test_serverURL(t *testing.T) {
 			id:   "dialer001",
 			want: "https://host:9443/base/revdial?id=dialer001",
 		},
+		{
+			name: "custom names",
+			host: "https://host:9443/base/",
+			id:   "dialer001",
+			opts: URLOptions{RevDialPath: "register", IDParam: "agent"},
+			want: "https://host:9443/base/register?agent=dialer001",
+		},
 		{
 			name:    "invalid host scheme",
 			host:    "http://host:9443/base",
@@ -38,7 +46,7 @@ func Test_serverURL(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := serverURL(tt.host, tt.id)
+			got, err := serverURL(tt.host, tt.id, tt.opts)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("serverURL() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -0,0 +1,145 @@
+package h2rev2
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// headers of the idle connections response, they carry the metadata
+// of the connection once it is picked up
+const (
+	headerNetwork    = "X-H2rev2-Network"
+	headerAddress    = "X-H2rev2-Address"
+	headerRemoteAddr = "X-H2rev2-Remote-Addr"
+	headerHost       = "X-H2rev2-Host"
+	headerPort       = "X-H2rev2-Port-Forward"
+)
+
+// Metadata describes a connection created through the reverse connections.
+type Metadata struct {
+	// ID of the reverse connections
+	ID string
+	// Network and Address requested on Dialer.Dial
+	Network string
+	Address string
+	// RemoteAddr is the address of the client the connection was dialed
+	// for, per example, of the request proxied or of the TCP connection
+	// accepted on the ReversePool. It is also returned by RemoteAddr().
+	RemoteAddr string
+	// Host requested by the client of the proxied request
+	Host string
+	// TraceContext has the W3C trace context headers of the connection,
+	// if the ReversePool and the Listener are traced
+	TraceContext map[string]string
+
+	// portForward is set if the Listener forwards the connection to its
+	// TCP target with the port of the Address
+	portForward bool
+}
+
+// Context returns a copy of ctx with the trace context of the connection,
+// so the spans created with it continue the trace of the request.
+func (m Metadata) Context(ctx context.Context) context.Context {
+	return extractTrace(ctx, m.TraceContext)
+}
+
+// MetadataFromConn returns the metadata of a connection accepted by the
+// Listener, it returns false if the connection was not created by this package.
+func MetadataFromConn(c net.Conn) (Metadata, bool) {
+	cc, ok := c.(*conn)
+	if !ok {
+		return Metadata{}, false
+	}
+	return cc.meta, true
+}
+
+// clientKey is the context key of the clientInfo
+type clientKey struct{}
+
+// clientInfo describes the client a connection is dialed for
+type clientInfo struct {
+	remoteAddr string
+	host       string
+}
+
+// ContextWithClient returns a copy of ctx with the address and the Host of
+// the client the connection is dialed for, Dialer.Dial forwards them to the
+// Listener. The ReversePool sets them on the requests proxied and on the
+// TCP connections accepted.
+func ContextWithClient(ctx context.Context, remoteAddr string, host string) context.Context {
+	return context.WithValue(ctx, clientKey{}, clientInfo{remoteAddr: remoteAddr, host: host})
+}
+
+// setMetadata sets the metadata of the connection, the remote address is
+// the one of the client, if known.
+func (c *conn) setMetadata(m Metadata) {
+	c.meta = m
+	if addr := parseAddr(m.RemoteAddr); addr != nil {
+		c.remoteAddr = addr
+	}
+}
+
+// dialTarget describes the connection requested to the Listener
+type dialTarget struct {
+	network    string
+	address    string
+	remoteAddr string            // address of the client
+	host       string            // Host requested by the client
+	forward    string            // host:port the Listener forwards the connection to, instead of accepting it
+	trace      map[string]string // trace context of the dial
+	// the Listener forwards the connection to its TCP target with the port
+	// of the address, if it has one
+	portForward bool
+}
+
+func (t dialTarget) metadata() Metadata {
+	return Metadata{
+		Network:      t.network,
+		Address:      t.address,
+		RemoteAddr:   t.remoteAddr,
+		Host:         t.host,
+		TraceContext: t.trace,
+		portForward:  t.portForward,
+	}
+}
+
+func (m Metadata) writeHeader(h http.Header) {
+	if m.Network != "" {
+		h.Set(headerNetwork, m.Network)
+	}
+	if m.Address != "" {
+		h.Set(headerAddress, m.Address)
+	}
+	if m.RemoteAddr != "" {
+		h.Set(headerRemoteAddr, m.RemoteAddr)
+	}
+	if m.Host != "" {
+		h.Set(headerHost, m.Host)
+	}
+	if m.portForward {
+		h.Set(headerPort, "true")
+	}
+	for k, v := range m.TraceContext {
+		h.Set(k, v)
+	}
+}
+
+func metadataFromHeader(h http.Header) Metadata {
+	m := Metadata{
+		Network:     h.Get(headerNetwork),
+		Address:     h.Get(headerAddress),
+		RemoteAddr:  h.Get(headerRemoteAddr),
+		Host:        h.Get(headerHost),
+		portForward: h.Get(headerPort) == "true",
+	}
+	for _, k := range propagator.Fields() {
+		if v := h.Get(k); v != "" {
+			if m.TraceContext == nil {
+				m.TraceContext = map[string]string{}
+			}
+			m.TraceContext[k] = v
+		}
+	}
+	return m
+}
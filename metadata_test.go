@@ -0,0 +1,168 @@
+package h2rev2
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	pool := NewReversePool()
+	publicServer := httptest.NewUnstartedServer(pool)
+	publicServer.EnableHTTP2 = true
+	publicServer.StartTLS()
+	defer publicServer.Close()
+	defer pool.Close()
+
+	for _, idle := range []int{0, 1} {
+		id := fmt.Sprintf("d%03d", idle)
+		l, err := NewListener(publicServer.Client(), publicServer.URL, id, WithIdleConns(idle))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		waitHandshake(t, pool, id)
+
+		go func() {
+			ctx := ContextWithClient(context.Background(), "192.0.2.1:1234", "example.com")
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			c, err := pool.GetDialer(id).Dial(ctx, "tcp", "internal.svc:8080")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.Write([]byte("x"))
+			defer c.Close()
+		}()
+
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Read(make([]byte, 1))
+		meta, ok := MetadataFromConn(c)
+		if !ok {
+			t.Fatalf("expected metadata on the accepted connection")
+		}
+		if meta.ID != id || meta.Network != "tcp" || meta.Address != "internal.svc:8080" || meta.Host != "example.com" {
+			t.Errorf("idle connections %d: unexpected metadata %+v", idle, meta)
+		}
+		if c.RemoteAddr().String() != "192.0.2.1:1234" {
+			t.Errorf("idle connections %d: expected remote address of the client, got %s", idle, c.RemoteAddr())
+		}
+		if c.LocalAddr().String() != l.Addr().String() {
+			t.Errorf("idle connections %d: expected local address %s, got %s", idle, l.Addr(), c.LocalAddr())
+		}
+		c.Close()
+	}
+}
+
+func TestEgressGateway(t *testing.T) {
+	echoAddr, stopEcho := echoServer(t)
+	defer stopEcho()
+
+	pool := NewReversePool()
+	_, _, stop := setupPool(t, pool, WithEgressGateway("127.0.0.0/8"))
+	defer stop()
+	d := pool.GetDialer("d001")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := d.Dial(ctx, "tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello egress\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello egress\n" {
+		t.Errorf("expected echo, got %q", line)
+	}
+
+	// addresses out of the allowlist are rejected
+	if _, err := d.Dial(ctx, "tcp", "10.0.0.1:80"); err == nil {
+		t.Errorf("expected error dialing an address not allowed")
+	}
+}
+
+func Test_addressAllowed(t *testing.T) {
+	tests := []struct {
+		allowlist []string
+		address   string
+		want      bool
+	}{
+		{nil, "10.0.0.1:80", true},
+		{[]string{"10.0.0.1:80"}, "10.0.0.1:80", true},
+		{[]string{"10.0.0.1:80"}, "10.0.0.1:81", false},
+		{[]string{"db.internal"}, "db.internal:5432", true},
+		{[]string{"db.internal"}, "web.internal:80", false},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:443", true},
+		{[]string{"10.0.0.0/8"}, "192.168.1.1:443", false},
+		{[]string{"10.0.0.0/8"}, "db.internal:5432", false},
+	}
+	for _, tt := range tests {
+		if got := addressAllowed(tt.allowlist, tt.address); got != tt.want {
+			t.Errorf("addressAllowed(%v, %s) = %v, want %v", tt.allowlist, tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestProxyClientAddress(t *testing.T) {
+	pool := NewReversePool()
+	publicServer, l, stop := setupPool(t, pool)
+	defer stop()
+	if l.Addr().Network() != "h2rev2" || !strings.HasPrefix(l.Addr().String(), publicServer.URL) {
+		t.Errorf("unexpected Listener address %s %s", l.Addr().Network(), l.Addr())
+	}
+
+	// the internal server sees the address of the client
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		meta, _ := MetadataFromConn(r.Context().Value(connContextKey{}).(net.Conn))
+		fmt.Fprintf(w, "%s %s %s", r.RemoteAddr, meta.ID, meta.Host)
+	}), ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connContextKey{}, c)
+	}}
+	go server.Serve(l)
+	defer server.Close()
+
+	var clientAddr string
+	client := publicServer.Client()
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			clientAddr = info.Conn.LocalAddr().String()
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, publicServer.URL+"/proxy/d001/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(publicServer.URL, "https://")
+	if want := clientAddr + " d001 " + host; string(body) != want {
+		t.Errorf("expected %q, got %q", want, body)
+	}
+}
+
+type connContextKey struct{}
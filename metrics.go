@@ -0,0 +1,108 @@
+package h2rev2
+
+import (
+	"time"
+)
+
+// Metrics records the metrics of the ReversePools, Dialers, Listeners and
+// their connections. The package github.com/aojea/h2rev2/prommetrics
+// implements it with Prometheus collectors:
+//
+//	metrics := prommetrics.New()
+//	prometheus.MustRegister(metrics)
+//	pool := h2rev2.NewReversePool()
+//	pool.Metrics = metrics
+type Metrics interface {
+	// DialerRegistered is called when a Dialer is registered in the pool.
+	DialerRegistered()
+	// DialerUnregistered is called when a Dialer is removed from the pool.
+	DialerUnregistered()
+	// ObserveDial is called when a dial completes, err is its result.
+	ObserveDial(duration time.Duration, err error)
+	// PickupFailed is called when the Listener of the id fails to pick up
+	// a reverse connection.
+	PickupFailed(id string)
+	// ListenerConnected is called when the control connection of the
+	// Listener of the id is established, or re-established if reconnect.
+	ListenerConnected(id string, reconnect bool)
+	// ListenerDisconnected is called when the control connection of the
+	// Listener of the id is lost.
+	ListenerDisconnected(id string)
+	// ConnOpened is called when a data connection of the tunnel id is
+	// opened on the side "pool" or "listener", the bytes received and sent
+	// over it are added to the counters returned.
+	ConnOpened(id string, side string) (rx Counter, tx Counter)
+	// ConnClosed is called when the data connection is closed.
+	ConnClosed(id string, side string)
+}
+
+// Counter accumulates the bytes transferred over a data connection,
+// prometheus.Counter implements it.
+type Counter interface {
+	Add(float64)
+}
+
+// side of the tunnel reported in the metrics
+const (
+	sidePool     = "pool"
+	sideListener = "listener"
+)
+
+// metrics records on m, if not nil.
+type metrics struct {
+	m Metrics
+}
+
+func (m metrics) dialerRegistered() {
+	if m.m == nil {
+		return
+	}
+	m.m.DialerRegistered()
+}
+
+func (m metrics) dialerUnregistered() {
+	if m.m == nil {
+		return
+	}
+	m.m.DialerUnregistered()
+}
+
+func (m metrics) observeDial(start time.Time, err error) {
+	if m.m == nil {
+		return
+	}
+	m.m.ObserveDial(time.Since(start), err)
+}
+
+func (m metrics) pickupFailed(id string) {
+	if m.m == nil {
+		return
+	}
+	m.m.PickupFailed(id)
+}
+
+func (m metrics) listenerConnectionUp(id string, reconnect bool) {
+	if m.m == nil {
+		return
+	}
+	m.m.ListenerConnected(id, reconnect)
+}
+
+func (m metrics) listenerConnectionDown(id string) {
+	if m.m == nil {
+		return
+	}
+	m.m.ListenerDisconnected(id)
+}
+
+// trackConn accounts the data connection c of the tunnel id until it is closed.
+func (m metrics) trackConn(c *conn, id string, side string) {
+	if m.m == nil {
+		return
+	}
+	c.addByteCounters(m.m.ConnOpened(id, side))
+	go func() {
+		<-c.Done()
+		m.m.ConnClosed(id, side)
+	}()
+}
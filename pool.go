@@ -1,50 +1,191 @@
 package h2rev2
 
 import (
+	"context"
 	"errors"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 )
 
-type controlMsg struct {
-	Command  string `json:"command,omitempty"`  // "keep-alive", "conn-ready", "pickup-failed"
-	ConnPath string `json:"connPath,omitempty"` // conn pick-up URL path for "conn-url", "pickup-failed"
-	Err      string `json:"err,omitempty"`
-}
-
 // ReversePool contains a pool of Dialers to create reverse connections
 // It exposes an http.Handler to handle the clients.
 // 	pool := h2rev2.NewReversePool()
 // 	mux := http.NewServeMux()
 //	mux.Handle("", pool)
+// The exported fields must be set before the pool starts handling requests.
 type ReversePool struct {
-	mu   sync.Mutex
-	pool map[string]*Dialer
+	// Authenticator, if not nil, authenticates the requests of the Listeners
+	// creating reverse connections. Requests denied get a 403 response.
+	Authenticator Authenticator
+	// Authorizer, if not nil, authorizes the requests proxied through the
+	// reverse connections. Requests denied get the status code returned.
+	// The credentials of a CredentialsAuthorizer are removed from the
+	// requests authorized.
+	Authorizer Authorizer
+	// Metrics, if not nil, records the metrics of the pool, its Dialers
+	// and the data connections.
+	Metrics Metrics
+	// Balancing selects how the connections are spread across the Listeners
+	// that share the same id, round robin by default.
+	Balancing BalancingPolicy
+	// ServerVersion is the software version announced to the Listeners.
+	ServerVersion string
+	// MinProtocolVersion rejects the Listeners with a lower protocol version.
+	// The Listeners that do not complete the handshake are always rejected.
+	MinProtocolVersion int
+	// RequiredCapabilities rejects the Listeners that do not support them.
+	RequiredCapabilities []string
+	// TracerProvider, if not nil, traces the requests proxied, the dials and
+	// the data connections. The W3C trace context is propagated to the
+	// Listeners, so they can continue the trace.
+	TracerProvider trace.TracerProvider
+	// Hooks are invoked on the lifecycle events of the Dialers and
+	// their data connections.
+	Hooks PoolHooks
+	// AllowTCPExposure, if not nil, allows the Listeners to request exposing
+	// TCP ports on the public host. It returns true if the Listener of the id
+	// can listen on the address addr. Requests are denied if nil.
+	AllowTCPExposure func(id string, addr string) bool
+	// URLOptions customizes the names used on the URLs, the Listeners must
+	// use the same with WithURLOptions.
+	URLOptions URLOptions
+	// HostSuffix, if not empty, routes the requests to the hosts
+	// <id><HostSuffix>, per example <id>.tunnels.example.com with the suffix
+	// ".tunnels.example.com", to the Dialer of the id. The path and the Host
+	// header are passed unchanged.
+	HostSuffix string
+	// HostRouter, if not nil, returns the id of the Dialer the requests to the
+	// host are routed to, or false if they are routed by path. It is used
+	// instead of HostSuffix.
+	HostRouter func(host string) (string, bool)
+	// ConnIdleTimeout, if not zero, closes the data connections that do not
+	// read or write any data during the timeout.
+	ConnIdleTimeout time.Duration
+	// ConnMaxLifetime, if not zero, closes the data connections once they
+	// are open for the lifetime.
+	ConnMaxLifetime time.Duration
+	// EnableConnectProxy allows the clients to use the pool as an HTTP proxy,
+	// the CONNECT requests to <port>.<id>.tunnel:<any port> or <id>:<port>
+	// are forwarded to the port through the reverse connections of the id.
+	EnableConnectProxy bool
+
+	mu        sync.Mutex
+	pool      map[string]*Dialer
+	exposures map[string]*tcpExposure // by listening address
+	blocked   map[string]bool         // ids not allowed to register
+	shutdownc chan struct{}           // closed when the pool is shutting down
+	streams   int                     // proxy requests and data connections active
+
+	// time to wait for the hello of the Listeners, handshakeTimeout if zero
+	handshakeTimeout time.Duration
 }
 
+// interval to check if the active streams completed on Shutdown
+const shutdownPollInterval = 100 * time.Millisecond
+
 // NewReversePool returns a ReversePool
 func NewReversePool() *ReversePool {
 	return &ReversePool{
-		pool: map[string]*Dialer{},
+		pool:      map[string]*Dialer{},
+		exposures: map[string]*tcpExposure{},
+		blocked:   map[string]bool{},
+		shutdownc: make(chan struct{}),
 	}
 }
 
 // Close the Reverse pool and all its dialers
 func (rp *ReversePool) Close() {
 	rp.mu.Lock()
-	defer rp.mu.Unlock()
+	dialers := make([]*Dialer, 0, len(rp.pool))
 	for _, v := range rp.pool {
-		v.Close()
+		dialers = append(dialers, v)
+	}
+	for k, e := range rp.exposures {
+		e.ln.Close()
+		delete(rp.exposures, k)
+	}
+	rp.mu.Unlock()
+	// the hooks are invoked without holding the lock
+	for _, d := range dialers {
+		d.closeWithReason(ReasonPoolClosed)
 	}
 }
 
+// Shutdown gracefully shuts down the pool, it stops accepting new Listeners,
+// proxy requests and TCP connections, and waits for the active ones to
+// complete before closing the pool. If the context expires first, the pool
+// is closed and the context error is returned.
+func (rp *ReversePool) Shutdown(ctx context.Context) error {
+	rp.mu.Lock()
+	if !isClosedChan(rp.shutdownc) {
+		close(rp.shutdownc)
+	}
+	for k, e := range rp.exposures {
+		e.ln.Close()
+		delete(rp.exposures, k)
+	}
+	rp.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		rp.mu.Lock()
+		streams := rp.streams
+		rp.mu.Unlock()
+		if streams == 0 {
+			rp.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			rp.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// isShuttingDown returns true once Shutdown has been called
+func (rp *ReversePool) isShuttingDown() bool {
+	return isClosedChan(rp.shutdownc)
+}
+
+// metrics returns the metrics of the pool, nothing is recorded if not set.
+func (rp *ReversePool) metrics() metrics {
+	return metrics{rp.Metrics}
+}
+
+// streamStarted accounts an active stream, new streams are rejected once
+// the pool is shutting down, the ones serving an in-flight dial are not.
+func (rp *ReversePool) streamStarted(isNew bool) bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if isNew && isClosedChan(rp.shutdownc) {
+		return false
+	}
+	rp.streams++
+	return true
+}
+
+func (rp *ReversePool) streamDone() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.streams--
+}
+
 // GetDialer returns a reverse dialer for the id
 func (rp *ReversePool) GetDialer(id string) *Dialer {
 	rp.mu.Lock()
@@ -52,46 +193,86 @@ func (rp *ReversePool) GetDialer(id string) *Dialer {
 	return rp.pool[id]
 }
 
-// CreateDialer creates a reverse dialer with id
-// it's a noop if a dialer already exists
+// CreateDialer creates a reverse dialer with id using conn as control
+// connection, if a dialer already exists conn is added to it as the
+// control connection of another Listener. It returns nil if the id is blocked.
 func (rp *ReversePool) CreateDialer(id string, conn net.Conn) *Dialer {
+	d, _ := rp.register(id, "", conn.RemoteAddr().String(), conn)
+	return d
+}
+
+// register adds the control connection to the dialer with id, creating it
+// if it does not exist or if it is closed. It returns nil if the id is blocked.
+func (rp *ReversePool) register(id string, sid string, remoteAddr string, conn net.Conn) (*Dialer, *session) {
 	rp.mu.Lock()
-	defer rp.mu.Unlock()
-	if d, ok := rp.pool[id]; ok {
-		return d
+	if rp.blocked[id] {
+		rp.mu.Unlock()
+		return nil, nil
+	}
+	old, ok := rp.pool[id]
+	if ok {
+		if s := old.addSession(sid, remoteAddr, conn); s != nil {
+			rp.mu.Unlock()
+			return old, s
+		}
+		// the dialer is closing, replace it
+		delete(rp.pool, id)
+		rp.metrics().dialerUnregistered()
 	}
-	d := NewDialer(id, conn)
+	d := newDialer(id, rp)
+	s := d.addSession(sid, remoteAddr, conn)
 	rp.pool[id] = d
-	return d
+	rp.metrics().dialerRegistered()
+	rp.mu.Unlock()
 
+	e := DialerEvent{ID: id, Time: d.created, RemoteAddr: remoteAddr}
+	if ok {
+		e.Duration = d.created.Sub(old.created)
+		rp.Hooks.dialerReplaced(e)
+	} else {
+		rp.Hooks.dialerRegistered(e)
+	}
+	return d, s
 }
 
 // DeleteDialer delete the reverse dialer for the id
 func (rp *ReversePool) DeleteDialer(id string) {
 	rp.mu.Lock()
 	defer rp.mu.Unlock()
-	delete(rp.pool, id)
+	if _, ok := rp.pool[id]; ok {
+		delete(rp.pool, id)
+		rp.metrics().dialerUnregistered()
+	}
+}
+
+// removeDialer deletes the reverse dialer for the id only if it is d
+func (rp *ReversePool) removeDialer(id string, d *Dialer) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.pool[id] == d {
+		delete(rp.pool, id)
+		rp.metrics().dialerUnregistered()
+	}
 }
 
 // HTTP Handler that handles reverse connections and reverse proxy requests using 2 different paths:
 // path base/revdial?key=id establish reverse connections and queue them so it can be consumed by the dialer
 // path base/proxy/id/(path) proxies the (path) through the reverse connection identified by id
+// The requests to the hosts routed with HostSuffix or HostRouter are proxied with any path.
 func (rp *ReversePool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// recover panic
-	defer func() {
-		if r := recover(); r != nil {
-			var err error
-			switch t := r.(type) {
-			case string:
-				err = errors.New(t)
-			case error:
-				err = t
-			default:
-				err = errors.New("Unknown error")
-			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	}()
+	defer recoverError(w)
+
+	// forward proxy CONNECT <port>.<id>.tunnel:443
+	if isProxyConnect(r) {
+		rp.serveConnect(w, r)
+		return
+	}
+
+	// virtual hosts <id>.tunnels.example.com
+	if id, ok := rp.hostID(r.Host); ok {
+		rp.serveProxy(w, r, id, r.Host)
+		return
+	}
 
 	// process path
 	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
@@ -99,94 +280,406 @@ func (rp *ReversePool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "", http.StatusNotFound)
 		return
 	}
-	// route the request
-	pos := -1
-	for i := len(path) - 1; i >= 0; i-- {
-		p := path[i]
-		// pathRevDial comes with a param
-		if p == pathRevDial {
-			if i != len(path)-1 {
-				http.Error(w, "revdial: only last element on path allowed", http.StatusInternalServerError)
-				return
-			}
-			pos = i
-			break
-		}
-		// pathRevProxy requires at least the id subpath
-		if p == pathRevProxy {
+	// route the request, the first element that matches wins so the
+	// proxied paths can contain the same names
+	revDialPath := rp.URLOptions.revDialPath()
+	proxyPath := rp.URLOptions.proxyPath()
+	for i, p := range path {
+		// proxyPath requires at least the id subpath
+		if p == proxyPath {
 			if i == len(path)-1 {
 				http.Error(w, "proxy: reverse path id required", http.StatusInternalServerError)
 				return
 			}
-			pos = i
-			break
+			// Forward proxy /base/proxy/id/..proxied path...
+			id := path[i+1]
+			rp.serveProxy(w, r, id, id)
+			return
+		}
+		// revDialPath comes with a param
+		if p == revDialPath && i == len(path)-1 {
+			rp.serveRevDial(w, r)
+			return
+		}
+	}
+	http.Error(w, "revdial: not handler ", http.StatusNotFound)
+}
+
+// RegistrationHandler returns an http.Handler for the reverse connections
+// of the Listeners, that can be mounted on any path, router or server. The
+// Listeners must connect to that path followed by the RevDialPath of the
+// URLOptions, per example:
+//
+//	mux.Handle("/tunnels/revdial", pool.RegistrationHandler())
+//	l, err := h2rev2.NewListener(client, "https://public.server.url/tunnels", "revdialer0001")
+func (rp *ReversePool) RegistrationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer recoverError(w)
+		rp.serveRevDial(w, r)
+	})
+}
+
+// ProxyHandler returns an http.Handler that proxies the requests through the
+// reverse connections of the id returned by idFunc, per example the element
+// of the path after the prefix, with the path unchanged:
+//
+//	mux.Handle("/apps/", pool.ProxyHandler(func(r *http.Request) string {
+//		// /apps/<id>/<path>
+//		return strings.Split(strings.TrimPrefix(r.URL.Path, "/apps/"), "/")[0]
+//	}))
+func (rp *ReversePool) ProxyHandler(idFunc func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer recoverError(w)
+		id := idFunc(r)
+		if id == "" {
+			http.Error(w, "proxy: reverse path id required", http.StatusNotFound)
+			return
 		}
+		rp.serveProxy(w, r, id, id)
+	})
+}
+
+// recoverError replies with the error of the handler panics.
+func recoverError(w http.ResponseWriter) {
+	if r := recover(); r != nil {
+		// the handler aborts the response on purpose
+		if r == http.ErrAbortHandler {
+			panic(r)
+		}
+		var err error
+		switch t := r.(type) {
+		case string:
+			err = errors.New(t)
+		case error:
+			err = t
+		default:
+			err = errors.New("Unknown error")
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	if pos < 0 {
-		http.Error(w, "revdial: not handler ", http.StatusNotFound)
+}
+
+// serveRevDial handles the reverse connections of the Listeners.
+func (rp *ReversePool) serveRevDial(w http.ResponseWriter, r *http.Request) {
+	// The caller identify itself by the value of the keu
+	// https://server/revdial?id=dialerUniq
+	dialerUniq := r.URL.Query().Get(rp.URLOptions.idParam())
+	if len(dialerUniq) == 0 {
+		http.Error(w, "only reverse connections with id supported", http.StatusInternalServerError)
 		return
 	}
-	// Forward proxy /base/proxy/id/..proxied path...
-	if path[pos] == pathRevProxy {
-		id := path[pos+1]
-		target, err := url.Parse("http://" + id)
-		if err != nil {
-			http.Error(w, "wrong url", http.StatusInternalServerError)
+	if rp.Authenticator != nil {
+		if err := rp.Authenticator.Authenticate(r, dialerUniq); err != nil {
+			klog.V(2).Infof("reverse connection from %s id %s rejected: %v", r.RemoteAddr, dialerUniq, err)
+			http.Error(w, "reverse connection not allowed", http.StatusForbidden)
 			return
 		}
-		d := rp.GetDialer(id)
-		if d == nil {
-			http.Error(w, "not reverse connections for this id available", http.StatusInternalServerError)
+	}
+	if rp.IsBlocked(dialerUniq) {
+		klog.V(2).Infof("reverse connection from %s id %s rejected: id blocked", r.RemoteAddr, dialerUniq)
+		http.Error(w, "reverse connection blocked", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	token := q.Get(urlParamConn)
+	// control connections register the Listener and start the control loop
+	if token == "" && q.Get(urlParamIdle) == "" {
+		// the Listeners without sessions dial their data connections on the
+		// same URL, they can not be told apart from the control connections
+		sid := q.Get(urlParamSession)
+		if sid == "" {
+			log.Printf("revdial.ReversePool: reverse connection from %s id %s rejected: Listener without session not supported, upgrade it", r.RemoteAddr, dialerUniq)
+			http.Error(w, "revdial: Listener not supported, the control connections require a session", http.StatusUpgradeRequired)
 			return
 		}
-		transport := d.reverseClient().Transport
-		proxy := httputil.NewSingleHostReverseProxy(target)
-		originalDirector := proxy.Director
-		proxy.Transport = transport
-		proxy.Director = func(req *http.Request) {
-			req.Host = target.Host
-			originalDirector(req)
-		}
-		proxy.FlushInterval = -1
-		proxy.ServeHTTP(w, r)
-		klog.V(5).Infof("proxy server closed %v ", err)
-	} else {
-		// The caller identify itself by the value of the keu
-		// https://server/revdial?id=dialerUniq
-		dialerUniq := r.URL.Query().Get(urlParamKey)
-		if len(dialerUniq) == 0 {
-			http.Error(w, "only reverse connections with id supported", http.StatusInternalServerError)
+		if rp.isShuttingDown() {
+			http.Error(w, "reverse pool shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		conn := newRequestConn(w, r)
+		d, s := rp.register(dialerUniq, sid, r.RemoteAddr, conn)
+		if d == nil {
+			abandonConn(conn)
+			http.Error(w, "reverse connection blocked", http.StatusForbidden)
 			return
 		}
+		// flush the response headers once registered
+		conn.sendHeaders(w, nil)
+		<-conn.ended
+		s.Close()
+		if isClosedChan(d.Done()) {
+			rp.removeDialer(dialerUniq, d)
+		}
+		klog.V(5).Infof("stoped dialer %s control connection ", dialerUniq)
+		finishResponse(conn)
+		return
+	}
+	// idle connections are parked until a dial picks them up
+	if token == "" {
+		rp.serveIdleConn(w, r, dialerUniq, q.Get(urlParamSession))
+		return
+	}
+	// the connections requested by in-flight dials are served until the pool is closed
+	rp.streamStarted(false)
+	defer rp.streamDone()
+	d := rp.GetDialer(dialerUniq)
+	if d == nil {
+		http.Error(w, "not reverse dialer for this id", http.StatusNotFound)
+		return
+	}
+	// claim the dial before sending the response headers, the Listener
+	// only gets a connection if there is a dial waiting for it
+	pd, ok := d.claim(token)
+	if !ok {
+		http.Error(w, "no dial waiting for this connection", http.StatusNotFound)
+		return
+	}
+	// First flush response headers, the pick-up token identifies the connection
+	w.Header().Set(headerConnID, token)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	// create a reverse connection
+	klog.V(5).Infof("created reverse connection to %s %s id %s", r.RequestURI, r.RemoteAddr, dialerUniq)
+	conn := newRequestConn(w, r)
+	conn.id = token
+	rp.metrics().trackConn(conn, dialerUniq, sidePool)
+	d.trackConn(conn)
+	// hand the connection to the dial that requested it, it may have
+	// given up while the response headers were sent
+	s, ok := d.complete(pd, pickup{conn: conn})
+	if !ok {
+		abandonConn(conn)
+		finishResponse(conn)
+		return
+	}
+	// keep the handler alive until the connection is closed and its stream ended
+	<-conn.ended
+	d.release(s)
+	klog.V(5).Infof("Connection from %s done", r.RemoteAddr)
+	finishResponse(conn)
+}
+
+// hostID returns the id of the Dialer the requests to the host are routed to.
+func (rp *ReversePool) hostID(host string) (string, bool) {
+	if rp.HostRouter != nil {
+		return rp.HostRouter(host)
+	}
+	if rp.HostSuffix == "" {
+		return "", false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	suffix := rp.HostSuffix
+	if !strings.HasPrefix(suffix, ".") {
+		suffix = "." + suffix
+	}
+	if len(host) <= len(suffix) || !strings.EqualFold(host[len(host)-len(suffix):], suffix) {
+		return "", false
+	}
+	// only one label on the left of the suffix
+	id := host[:len(host)-len(suffix)]
+	if strings.Contains(id, ".") {
+		return "", false
+	}
+	return id, true
+}
 
-		d := rp.GetDialer(dialerUniq)
-		// First flush response headers
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+// startProxy starts the span of the request r of a client to the id and
+// authorizes it, the request returned carries the context of the span and
+// the address of the client. If it returns true, the caller ends the span
+// and calls streamDone, otherwise the response has been written.
+func (rp *ReversePool) startProxy(w http.ResponseWriter, r *http.Request, id string, attrs ...attribute.KeyValue) (*http.Request, trace.Span, bool) {
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := newTracer(rp.TracerProvider).Start(ctx, spanProxy,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrID.String(id), attribute.String("http.method", r.Method)),
+		trace.WithAttributes(attrs...),
+	)
+	// the Listener gets the address of the client
+	ctx = ContextWithClient(ctx, r.RemoteAddr, r.Host)
+	r = r.WithContext(ctx)
+	if !rp.streamStarted(true) {
+		http.Error(w, "reverse pool shutting down", http.StatusServiceUnavailable)
+		span.End()
+		return r, span, false
+	}
+	if rp.Authorizer != nil {
+		if allow, status := rp.Authorizer.Authorize(r, id); !allow {
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			// the proxy clients authenticate with the Proxy-Authorization header
+			if status == http.StatusUnauthorized && isProxyConnect(r) {
+				status = http.StatusProxyAuthRequired
+				w.Header().Set("Proxy-Authenticate", `Bearer realm="h2rev2"`)
+			}
+			klog.V(2).Infof("%s request from %s to id %s denied with status %d", r.Method, r.RemoteAddr, id, status)
+			http.Error(w, http.StatusText(status), status)
+			rp.streamDone()
+			span.End()
+			return r, span, false
 		}
-		// first connection to register the dialer and start the control loop
-		if d == nil || isClosedChan(d.Done()) {
-			conn := newConn(r.Body, flushWriter{w})
-			rp.DeleteDialer(dialerUniq)
-			d = rp.CreateDialer(dialerUniq, conn)
-			// start control loop
-			<-conn.Done()
-			klog.V(5).Infof("stoped dialer %s control connection ", dialerUniq)
-			return
+		// the credentials of the pool do not reach the Listener, the
+		// requests to the backend copy the headers of r
+		removeCredentials(rp.Authorizer, r)
+	}
+	return r, span, true
+}
 
+// serveProxy proxies the request through the reverse connections of the id,
+// with the Host header host.
+func (rp *ReversePool) serveProxy(w http.ResponseWriter, r *http.Request, id string, host string) {
+	r, span, ok := rp.startProxy(w, r, id, attribute.String("http.target", r.URL.Path))
+	if !ok {
+		return
+	}
+	defer span.End()
+	defer rp.streamDone()
+	target, err := url.Parse("http://" + id)
+	if err != nil {
+		http.Error(w, "wrong url", http.StatusInternalServerError)
+		return
+	}
+	d := rp.GetDialer(id)
+	if d == nil {
+		http.Error(w, "not reverse connections for this id available", http.StatusInternalServerError)
+		return
+	}
+	if isExtendedConnect(r) {
+		if err := rp.serveExtendedConnect(w, r, d, host); err != nil {
+			klog.V(2).Infof("extended CONNECT to id %s failed: %v", id, err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
 		}
-		// create a reverse connection
-		klog.V(5).Infof("created reverse connection to %s %s id %s", r.RequestURI, r.RemoteAddr, dialerUniq)
-		conn := newConn(r.Body, flushWriter{w})
+		return
+	}
+	transport := d.reverseClient().Transport
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	originalDirector := proxy.Director
+	proxy.Transport = transport
+	proxy.Director = func(req *http.Request) {
+		req.Host = host
+		originalDirector(req)
+		// the backend continues the trace
+		propagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		klog.V(2).Infof("proxy request to id %s failed: %v", id, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	proxy.FlushInterval = -1
+	proxy.ServeHTTP(w, r)
+	klog.V(5).Infof("proxy server closed %v ", err)
+}
+
+// serveIdleConn parks the idle connection of the Listener control connection
+// sid until a dial picks it up, then it sends the response headers.
+func (rp *ReversePool) serveIdleConn(w http.ResponseWriter, r *http.Request, id string, sid string) {
+	d := rp.GetDialer(id)
+	if d == nil {
+		http.Error(w, "not reverse dialer for this id", http.StatusNotFound)
+		return
+	}
+	s := d.getSession(sid)
+	if s == nil {
+		http.Error(w, "not control connection for this session", http.StatusNotFound)
+		return
+	}
+	if !s.hasCapability(CapabilityIdleConns) {
+		http.Error(w, "idle connections not negotiated", http.StatusBadRequest)
+		return
+	}
+	if rp.isShuttingDown() {
+		http.Error(w, "reverse pool shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	conn := newRequestConn(w, r)
+	ic := &idleConn{conn: conn, target: make(chan dialTarget, 1), ready: make(chan struct{})}
+	var t dialTarget
+	for {
 		select {
-		case d.incomingConn <- conn:
-		case <-d.Done():
-			http.Error(w, "Reverse dialer closed", http.StatusInternalServerError)
+		case s.idle <- ic:
+		case <-s.Done():
+			abandonConn(conn)
+			http.Error(w, "control connection closed", http.StatusServiceUnavailable)
+			return
+		case <-s.drainc:
+			abandonConn(conn)
+			http.Error(w, "listener draining", http.StatusServiceUnavailable)
 			return
+		case <-rp.shutdownc:
+			abandonConn(conn)
+			http.Error(w, "reverse pool shutting down", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			abandonConn(conn)
+			return
+		}
+		t = <-ic.target
+		// the dial can give up until the response headers are sent
+		if d.sendIdle(ic) {
+			break
 		}
-		// keep the handler alive until the connection is closed
-		<-conn.Done()
-		klog.V(5).Infof("Connection from %s done", r.RemoteAddr)
+		klog.V(5).Infof("idle reverse connection from %s id %s abandoned, parking it again", r.RemoteAddr, id)
+	}
+	rp.streamStarted(false)
+	defer rp.streamDone()
+	conn.id = newPickupToken()
+	rp.metrics().trackConn(conn, id, sidePool)
+	d.trackConn(conn)
+	// the metadata of the dial goes on the response headers
+	if s.hasCapability(CapabilityHalfClose) {
+		s.halfClose(conn)
+	}
+	conn.sendHeaders(w, func(h http.Header) {
+		t.metadata().writeHeader(h)
+		h.Set(headerConnID, conn.id)
+	})
+	close(ic.ready)
+	klog.V(5).Infof("idle reverse connection from %s id %s picked up", r.RemoteAddr, id)
+	// keep the handler alive until the connection is closed and its stream ended
+	<-conn.ended
+	d.release(s)
+	finishResponse(conn)
+}
+
+// newRequestConn returns a connection over the request r and its response,
+// with the addresses of the underlying connection.
+func newRequestConn(w http.ResponseWriter, r *http.Request) *conn {
+	c := newConn(r.Body, flushWriter{w})
+	c.responseReason(w)
+	// the Listener can end the request and keep reading the response
+	c.setPeerDone(r.Context().Done())
+	c.remoteAddr = parseAddr(r.RemoteAddr)
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.localAddr = addr
+	}
+	return c
+}
+
+// abandonConn closes the connection c of a request that is not served,
+// waiting for its stream to end before the handler returns.
+func abandonConn(c *conn) {
+	c.Close()
+	<-c.ended
+}
+
+// finishResponse aborts the response of the connection c if its stream was
+// aborted, per example, because the peer does not read or SetLinger(0).
+// The handler can not return while the writes on the response are in progress.
+func finishResponse(c *conn) {
+	if c.aborted {
+		panic(http.ErrAbortHandler)
 	}
 }
 
@@ -0,0 +1,235 @@
+package h2rev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReversePool_hostID(t *testing.T) {
+	tests := []struct {
+		host   string
+		suffix string
+		id     string
+		ok     bool
+	}{
+		{host: "d001.tunnels.example.com", suffix: ".tunnels.example.com", id: "d001", ok: true},
+		{host: "d001.tunnels.example.com:8443", suffix: "tunnels.example.com", id: "d001", ok: true},
+		{host: "D001.Tunnels.Example.com.", suffix: ".tunnels.example.com", id: "D001", ok: true},
+		{host: "a.d001.tunnels.example.com", suffix: ".tunnels.example.com"},
+		{host: "tunnels.example.com", suffix: ".tunnels.example.com"},
+		{host: ".tunnels.example.com", suffix: ".tunnels.example.com"},
+		{host: "d001.example.com", suffix: ".tunnels.example.com"},
+		{host: "d001.tunnels.example.com", suffix: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			rp := &ReversePool{HostSuffix: tt.suffix}
+			id, ok := rp.hostID(tt.host)
+			if id != tt.id || ok != tt.ok {
+				t.Errorf("hostID() = %s, %v, want %s, %v", id, ok, tt.id, tt.ok)
+			}
+		})
+	}
+}
+
+// serveHost replies on the Listener with the host and the path received
+func serveHost(l net.Listener) func() {
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s%s", r.Host, r.URL.RequestURI())
+	})}
+	go server.Serve(l)
+	return func() { server.Close() }
+}
+
+// getHost gets the path from the public server with the Host header, it
+// returns the body and the status code
+func getHost(t *testing.T, publicServer *httptest.Server, host, path string) (string, int) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, publicServer.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	resp, err := publicServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body), resp.StatusCode
+}
+
+func TestHostRouting(t *testing.T) {
+	pool := NewReversePool()
+	pool.HostSuffix = ".tunnels.example.com"
+	publicServer, l, stop := setupPool(t, pool)
+	defer stop()
+	defer serveHost(l)()
+
+	// the path and the host are not modified, even if they match the path routes
+	for _, path := range []string{"/", "/app/login?next=/home", "/proxy/d002/revdial"} {
+		body, code := getHost(t, publicServer, "d001.tunnels.example.com", path)
+		if code != http.StatusOK || body != "d001.tunnels.example.com"+path {
+			t.Errorf("expected %s, got %d %s", "d001.tunnels.example.com"+path, code, body)
+		}
+	}
+	// other hosts use the path routes
+	body, code := getHost(t, publicServer, "public.example.com", "/proxy/d001/app")
+	if code != http.StatusOK || body != "d001/proxy/d001/app" {
+		t.Errorf("expected path routed request, got %d %s", code, body)
+	}
+	// unknown ids
+	if _, code := getHost(t, publicServer, "d002.tunnels.example.com", "/"); code == http.StatusOK {
+		t.Errorf("expected request to unknown id to fail")
+	}
+}
+
+func TestHostRouter(t *testing.T) {
+	pool := NewReversePool()
+	pool.HostRouter = func(host string) (string, bool) {
+		return "d001", strings.HasPrefix(host, "www.")
+	}
+	publicServer, l, stop := setupPool(t, pool)
+	defer stop()
+	defer serveHost(l)()
+
+	body, code := getHost(t, publicServer, "www.example.com", "/index.html")
+	if code != http.StatusOK || body != "www.example.com/index.html" {
+		t.Errorf("expected host routed request, got %d %s", code, body)
+	}
+	body, code = getHost(t, publicServer, "public.example.com", "/proxy/d001/index.html")
+	if code != http.StatusOK || body != "d001/proxy/d001/index.html" {
+		t.Errorf("expected path routed request, got %d %s", code, body)
+	}
+}
+
+func TestRoutingNames(t *testing.T) {
+	pool := NewReversePool()
+	publicServer, l, stop := setupPool(t, pool)
+	defer stop()
+	defer serveHost(l)()
+
+	// the names on the proxied path are not routed
+	for _, path := range []string{"/proxy/d001/api/revdial", "/proxy/d001/proxy/d002/"} {
+		body, code := getHost(t, publicServer, "public.example.com", path)
+		if code != http.StatusOK || body != "d001"+path {
+			t.Errorf("expected %s, got %d %s", "d001"+path, code, body)
+		}
+	}
+}
+
+func TestURLOptions(t *testing.T) {
+	opts := URLOptions{RevDialPath: "register", ProxyPath: "apps", IDParam: "agent"}
+	pool := NewReversePool()
+	pool.URLOptions = opts
+	publicServer, l, stop := setupHandler(t, pool, pool, "/base", WithURLOptions(opts))
+	defer stop()
+	defer serveHost(l)()
+
+	body, code := getHost(t, publicServer, "public.example.com", "/base/apps/d001/proxy/index.html")
+	if code != http.StatusOK || body != "d001/base/apps/d001/proxy/index.html" {
+		t.Errorf("expected proxied request, got %d %s", code, body)
+	}
+	if _, code := getHost(t, publicServer, "public.example.com", "/base/proxy/d001/index.html"); code != http.StatusNotFound {
+		t.Errorf("expected default names not to be routed, got %d", code)
+	}
+}
+
+func TestRouteHandlers(t *testing.T) {
+	pool := NewReversePool()
+	mux := http.NewServeMux()
+	mux.Handle("/tunnels/revdial", pool.RegistrationHandler())
+	mux.Handle("/apps/", pool.ProxyHandler(func(r *http.Request) string {
+		// /apps/{id}/...
+		return strings.Split(strings.TrimPrefix(r.URL.Path, "/apps/"), "/")[0]
+	}))
+	publicServer, l, stop := setupHandler(t, pool, mux, "/tunnels")
+	defer stop()
+	defer serveHost(l)()
+
+	body, code := getHost(t, publicServer, "public.example.com", "/apps/d001/revdial")
+	if code != http.StatusOK || body != "d001/apps/d001/revdial" {
+		t.Errorf("expected proxied request, got %d %s", code, body)
+	}
+	if _, code := getHost(t, publicServer, "public.example.com", "/apps/"); code != http.StatusNotFound {
+		t.Errorf("expected request without id to fail, got %d", code)
+	}
+	if _, code := getHost(t, publicServer, "public.example.com", "/apps/d002/"); code == http.StatusOK {
+		t.Errorf("expected request to unknown id to fail")
+	}
+}
+
+func TestAbandonedDialNotAccepted(t *testing.T) {
+	// the pick-up of the connections arrives once the dials gave up
+	slowPickup := WithRequestEditor(func(r *http.Request) error {
+		if r.URL.Query().Get(urlParamConn) != "" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil
+	})
+	pool := NewReversePool()
+	_, l, stop := setupPool(t, pool, slowPickup)
+	defer stop()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	d := pool.GetDialer("d001")
+
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := d.Dial(ctx, "tcp", "d001:80")
+		cancel()
+		if err == nil {
+			t.Fatalf("dial %d: expected dial to give up", i)
+		}
+	}
+	select {
+	case c := <-accepted:
+		b, _ := ioutil.ReadAll(c)
+		t.Fatalf("abandoned connection accepted: %q", b)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// there is no dial waiting for unknown pick-up tokens
+	_, err := l.dial(context.Background(), url.Values{urlParamConn: {"unknown"}})
+	var se *statusError
+	if !errors.As(err, &se) || se.code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %v", http.StatusNotFound, err)
+	}
+}
+
+func TestPathProxyWithPortTarget(t *testing.T) {
+	for _, idle := range []int{0, 1} {
+		t.Run(fmt.Sprintf("idle=%d", idle), func(t *testing.T) {
+			pool := NewReversePool()
+			// the port of the proxied requests is only used for CONNECT
+			publicServer, l, stop := setupPool(t, pool, WithTCPTargets("127.0.0.1:80"), WithIdleConns(idle))
+			defer stop()
+			defer serveHost(l)()
+
+			body, code := getHost(t, publicServer, "public.example.com", "/proxy/d001/index.html")
+			if code != http.StatusOK || body != "d001/proxy/d001/index.html" {
+				t.Errorf("expected request served by the Listener, got %d %s", code, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+// Package prommetrics implements the h2rev2.Metrics with Prometheus.
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/aojea/h2rev2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "h2rev2"
+
+var (
+	_ prometheus.Collector = (*Metrics)(nil)
+	_ h2rev2.Metrics       = (*Metrics)(nil)
+)
+
+// Metrics collects the metrics of the ReversePools, Dialers, Listeners and
+// their connections. It implements prometheus.Collector, so applications can
+// register it in their own registry:
+//
+//	metrics := prommetrics.New()
+//	prometheus.MustRegister(metrics)
+//	pool := h2rev2.NewReversePool()
+//	pool.Metrics = metrics
+type Metrics struct {
+	registeredDialers  prometheus.Gauge
+	dialDuration       *prometheus.HistogramVec
+	pickupFailures     *prometheus.CounterVec
+	activeConns        *prometheus.GaugeVec
+	connBytes          *prometheus.CounterVec
+	listenerConnected  *prometheus.GaugeVec
+	listenerReconnects *prometheus.CounterVec
+}
+
+// New returns a new set of metrics.
+func New() *Metrics {
+	return &Metrics{
+		registeredDialers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "pool",
+			Name:      "registered_dialers",
+			Help:      "Number of Dialers registered in the ReversePool.",
+		}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "dialer",
+			Name:      "dial_duration_seconds",
+			Help:      "Time to obtain a reverse connection from the Listener.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, []string{"result"}),
+		pickupFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "dialer",
+			Name:      "pickup_failures_total",
+			Help:      "Number of reverse connections the Listener failed to pick up.",
+		}, []string{"id"}),
+		activeConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_connections",
+			Help:      "Number of data connections open.",
+		}, []string{"side"}),
+		connBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connection_bytes_total",
+			Help:      "Bytes transferred over the data connections.",
+		}, []string{"id", "side", "direction"}),
+		listenerConnected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "listener",
+			Name:      "connected",
+			Help:      "Whether the Listener control connection is established.",
+		}, []string{"id"}),
+		listenerReconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "listener",
+			Name:      "reconnects_total",
+			Help:      "Number of times the Listener re-established the control connection.",
+		}, []string{"id"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.registeredDialers,
+		m.dialDuration,
+		m.pickupFailures,
+		m.activeConns,
+		m.connBytes,
+		m.listenerConnected,
+		m.listenerReconnects,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// DialerRegistered implements h2rev2.Metrics.
+func (m *Metrics) DialerRegistered() {
+	m.registeredDialers.Inc()
+}
+
+// DialerUnregistered implements h2rev2.Metrics.
+func (m *Metrics) DialerUnregistered() {
+	m.registeredDialers.Dec()
+}
+
+// ObserveDial implements h2rev2.Metrics.
+func (m *Metrics) ObserveDial(duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.dialDuration.WithLabelValues(result).Observe(duration.Seconds())
+}
+
+// PickupFailed implements h2rev2.Metrics.
+func (m *Metrics) PickupFailed(id string) {
+	m.pickupFailures.WithLabelValues(id).Inc()
+}
+
+// ListenerConnected implements h2rev2.Metrics.
+func (m *Metrics) ListenerConnected(id string, reconnect bool) {
+	m.listenerConnected.WithLabelValues(id).Set(1)
+	if reconnect {
+		m.listenerReconnects.WithLabelValues(id).Inc()
+	}
+}
+
+// ListenerDisconnected implements h2rev2.Metrics.
+func (m *Metrics) ListenerDisconnected(id string) {
+	m.listenerConnected.WithLabelValues(id).Set(0)
+}
+
+// ConnOpened implements h2rev2.Metrics.
+func (m *Metrics) ConnOpened(id string, side string) (h2rev2.Counter, h2rev2.Counter) {
+	m.activeConns.WithLabelValues(side).Inc()
+	return m.connBytes.WithLabelValues(id, side, "rx"), m.connBytes.WithLabelValues(id, side, "tx")
+}
+
+// ConnClosed implements h2rev2.Metrics.
+func (m *Metrics) ConnClosed(id string, side string) {
+	m.activeConns.WithLabelValues(side).Dec()
+}
@@ -0,0 +1,98 @@
+package prommetrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aojea/h2rev2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello world")
+	}))
+	defer backend.Close()
+
+	metrics := New()
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	// public server
+	pool := h2rev2.NewReversePool()
+	pool.Metrics = metrics
+	publicServer := httptest.NewUnstartedServer(pool)
+	publicServer.EnableHTTP2 = true
+	publicServer.StartTLS()
+	defer publicServer.Close()
+
+	// private server
+	l, err := h2rev2.NewListener(publicServer.Client(), publicServer.URL, "d001", h2rev2.WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	url, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: httputil.NewSingleHostReverseProxy(url)}
+	go server.Serve(l)
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	if v := testutil.ToFloat64(metrics.registeredDialers); v != 1 {
+		t.Errorf("registered dialers = %v, want 1", v)
+	}
+	if v := testutil.ToFloat64(metrics.listenerConnected.WithLabelValues("d001")); v != 1 {
+		t.Errorf("listener connected = %v, want 1", v)
+	}
+
+	resp, err := publicServer.Client().Get(publicServer.URL + "/proxy/d001/")
+	if err != nil {
+		t.Fatalf("Request Failed: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Reading body failed: %s", err)
+	}
+	if string(body) != "Hello world" {
+		t.Errorf("Expected %s received %s", "Hello world", string(body))
+	}
+
+	if n := testutil.CollectAndCount(metrics.dialDuration); n != 1 {
+		t.Errorf("dial duration series = %d, want 1", n)
+	}
+	for _, side := range []string{"pool", "listener"} {
+		for _, dir := range []string{"rx", "tx"} {
+			if v := testutil.ToFloat64(metrics.connBytes.WithLabelValues("d001", side, dir)); v == 0 {
+				t.Errorf("no bytes accounted for side %s direction %s", side, dir)
+			}
+		}
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Errorf("gathering metrics: %v", err)
+	}
+
+	// unregister the dialer when the control connection goes away
+	l.Close()
+	for i := 0; i < 10; i++ {
+		if testutil.ToFloat64(metrics.registeredDialers) == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if v := testutil.ToFloat64(metrics.registeredDialers); v != 0 {
+		t.Errorf("registered dialers = %v, want 0", v)
+	}
+}
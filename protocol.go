@@ -0,0 +1,79 @@
+package h2rev2
+
+import (
+	"errors"
+	"time"
+)
+
+// ProtocolVersion is the version of the control protocol implemented by
+// this package. It is exchanged in the hello/hello-ack handshake, the peers
+// speak the lowest version of both.
+const ProtocolVersion = 1
+
+// Capabilities of the control protocol, the features are only used if both
+// peers announce them in the handshake.
+const (
+	// CapabilityTCPForward allows the Dialer to request connections that the
+	// Listener forwards to a host:port.
+	CapabilityTCPForward = "tcp-forward"
+	// CapabilityTCPExpose allows the Listener to request exposing TCP ports
+	// on the public host.
+	CapabilityTCPExpose = "tcp-expose"
+	// CapabilityIdleConns allows the Listener to park idle connections.
+	CapabilityIdleConns = "idle-conns"
+	// CapabilityHalfClose allows the Dialer to end the writes of the data
+	// connections and keep reading.
+	CapabilityHalfClose = "half-close"
+)
+
+// capabilities supported by this package
+var supportedCapabilities = []string{
+	CapabilityTCPForward,
+	CapabilityTCPExpose,
+	CapabilityIdleConns,
+	CapabilityHalfClose,
+}
+
+// time the Dialer waits for the hello of the Listener before closing the
+// control connection
+const handshakeTimeout = 10 * time.Second
+
+// ErrIncompatiblePeer is returned when the peer rejects the handshake.
+var ErrIncompatiblePeer = errors.New("revdial: incompatible peer")
+
+type controlMsg struct {
+	Command  string `json:"command,omitempty"`  // "hello", "hello-ack", "keep-alive", "conn-ready", "pickup-failed", "expose-tcp", "expose-tcp-result", "drain", "conn-close", "conn-close-write"
+	ConnPath string `json:"connPath,omitempty"` // conn pick-up token for "conn-ready", "pickup-failed", conn id for "conn-close", "conn-close-write"
+	Forward  string `json:"forward,omitempty"`  // host:port to forward the connection for "conn-ready", "expose-tcp"
+	Network  string `json:"network,omitempty"`  // network requested to the Dialer for "conn-ready"
+	Address  string `json:"address,omitempty"`  // address requested to the Dialer for "conn-ready", public address to listen on for "expose-tcp", "expose-tcp-result"
+	Err      string `json:"err,omitempty"`
+	Offset   int64  `json:"offset,omitempty"` // bytes written before ending the writes for "conn-close-write"
+
+	// client the connection is dialed for on "conn-ready"
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Host       string `json:"host,omitempty"`
+
+	// the Listener forwards the connection to its TCP target with the
+	// port of the Address for "conn-ready"
+	PortForward bool `json:"portForward,omitempty"`
+
+	// W3C trace context headers of the dial for "conn-ready"
+	Trace map[string]string `json:"trace,omitempty"`
+
+	// handshake
+	Version      int      `json:"version,omitempty"`      // protocol version for "hello", "hello-ack"
+	Agent        string   `json:"agent,omitempty"`        // software version of the peer for "hello", "hello-ack"
+	Capabilities []string `json:"capabilities,omitempty"` // announced on "hello", negotiated on "hello-ack"
+}
+
+// intersect returns the elements of a that are also in b.
+func intersect(a, b []string) []string {
+	var out []string
+	for _, v := range a {
+		if strSliceContains(b, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package h2rev2
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	pool := NewReversePool()
+	pool.ServerVersion = "server-v1"
+	_, _, stop := setupPool(t, pool, WithAgentVersion("agent-v1"))
+	defer stop()
+
+	d := pool.GetDialer("d001")
+	d.mu.Lock()
+	s := d.sessions[0]
+	version, agent, capabilities := s.version, s.agent, s.capabilities
+	d.mu.Unlock()
+	if version != ProtocolVersion {
+		t.Errorf("version = %d, want %d", version, ProtocolVersion)
+	}
+	if agent != "agent-v1" {
+		t.Errorf("agent = %s, want agent-v1", agent)
+	}
+	if !reflect.DeepEqual(capabilities, supportedCapabilities) {
+		t.Errorf("capabilities = %v, want %v", capabilities, supportedCapabilities)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*ReversePool)
+	}{
+		{
+			name: "protocol version",
+			config: func(rp *ReversePool) {
+				rp.MinProtocolVersion = ProtocolVersion + 1
+			},
+		},
+		{
+			name: "capabilities",
+			config: func(rp *ReversePool) {
+				rp.RequiredCapabilities = []string{"teleport"}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewReversePool()
+			tt.config(pool)
+			publicServer := httptest.NewUnstartedServer(pool)
+			publicServer.EnableHTTP2 = true
+			publicServer.StartTLS()
+			defer publicServer.Close()
+			defer pool.Close()
+
+			l, err := NewListener(publicServer.Client(), publicServer.URL, "d001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := l.Accept()
+				errCh <- err
+			}()
+			select {
+			case err := <-errCh:
+				if !errors.Is(err, ErrIncompatiblePeer) {
+					t.Errorf("expected incompatible peer error, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Listener not closed after being rejected")
+			}
+		})
+	}
+}
+
+// TestHandshakeMissing checks the control connections that do not send the
+// hello are closed, even without a minimum protocol version.
+func TestHandshakeMissing(t *testing.T) {
+	pool := NewReversePool()
+	pool.handshakeTimeout = 100 * time.Millisecond
+	publicServer := httptest.NewUnstartedServer(pool)
+	publicServer.EnableHTTP2 = true
+	publicServer.StartTLS()
+	defer publicServer.Close()
+	defer pool.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequest("GET", publicServer.URL+"/revdial?id=d001&session=s001", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := publicServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	d := pool.GetDialer("d001")
+	if d == nil {
+		t.Fatal("dialer not registered")
+	}
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("control connection without handshake not closed")
+	}
+}
@@ -0,0 +1,105 @@
+package h2rev2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// signature of the PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WithProxyProtocol prepends a PROXY protocol header, version 1 or 2, to the
+// connections the Listener forwards to a TCP target or, if it is an egress
+// gateway, to the address requested. The header carries the address of the
+// client seen by the ReversePool, so the backends can log and filter it.
+func WithProxyProtocol(version int) ListenerOption {
+	return func(ln *Listener) {
+		ln.proxyProtocol = version
+	}
+}
+
+// WriteProxyHeader writes the PROXY protocol header, version 1 or 2, with
+// the source and destination addresses of the connection. The addresses that
+// are not TCP addresses are sent as unknown.
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case 1:
+		header = proxyHeaderV1(src, dst)
+	case 2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("PROXY protocol version %d not supported", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyAddrs returns the TCP addresses of the connection, both of the same
+// family, or false if they are not known.
+func proxyAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok := src.(*net.TCPAddr)
+	if !ok || s.IP == nil {
+		return nil, nil, false
+	}
+	d, ok := dst.(*net.TCPAddr)
+	if !ok || d.IP == nil {
+		return nil, nil, false
+	}
+	// mixed families are sent as IPv6
+	if (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		s = &net.TCPAddr{IP: s.IP.To16(), Port: s.Port}
+		d = &net.TCPAddr{IP: d.IP.To16(), Port: d.Port}
+	} else if s.IP.To4() != nil {
+		s = &net.TCPAddr{IP: s.IP.To4(), Port: s.Port}
+		d = &net.TCPAddr{IP: d.IP.To4(), Port: d.Port}
+	}
+	return s, d, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	s, d, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	if len(s.IP) == net.IPv6len {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, proxyIP(s.IP), proxyIP(d.IP), s.Port, d.Port))
+}
+
+// proxyIP formats the IP, the IPv4-mapped IPv6 addresses keep the IPv6 format.
+func proxyIP(ip net.IP) string {
+	if len(ip) == net.IPv6len && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	s, d, ok := proxyAddrs(src, dst)
+	if !ok {
+		// LOCAL command, the receiver uses the addresses of the connection
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	// PROXY command over TCP
+	buf.WriteByte(0x21)
+	if len(s.IP) == net.IPv4len {
+		buf.WriteByte(0x11)
+	} else {
+		buf.WriteByte(0x21)
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(s.IP)+4))
+	buf.Write(s.IP)
+	buf.Write(d.IP)
+	binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+	return buf.Bytes()
+}
@@ -0,0 +1,116 @@
+package h2rev2
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	sig := string(proxyV2Signature)
+	tests := []struct {
+		name    string
+		version int
+		src     net.Addr
+		dst     net.Addr
+		want    string
+	}{
+		{"v1 tcp4", 1, v4src, v4dst, "PROXY TCP4 192.0.2.1 10.0.0.1 56324 443\r\n"},
+		{"v1 tcp6", 1, v6src, v6dst, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"},
+		{"v1 mixed", 1, v4src, v6dst, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n"},
+		{"v1 unknown", 1, connAddr{}, v4dst, "PROXY UNKNOWN\r\n"},
+		{"v2 tcp4", 2, v4src, v4dst, sig + "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\x0a\x00\x00\x01" + "\xdc\x04" + "\x01\xbb"},
+		{"v2 tcp6", 2, v6src, v6dst, sig + "\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\xdc\x04" + "\x01\xbb"},
+		{"v2 unknown", 2, hostAddr("example.com:80"), v4dst, sig + "\x20\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteProxyHeader(&buf, tt.version, tt.src, tt.dst); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("expected header %q, got %q", tt.want, got)
+			}
+		})
+	}
+	if err := WriteProxyHeader(io.Discard, 3, v4src, v4dst); err == nil {
+		t.Errorf("expected error on unsupported version")
+	}
+}
+
+// proxyHeaderServer returns the address of a TCP server that replies with the
+// PROXY protocol v1 header received
+func proxyHeaderServer(t *testing.T) (string, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				line, err := bufio.NewReader(c).ReadString('\n')
+				if err != nil {
+					return
+				}
+				c.Write([]byte(line))
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestListenerProxyProtocol(t *testing.T) {
+	backendAddr, stopBackend := proxyHeaderServer(t)
+	defer stopBackend()
+
+	pool := NewReversePool()
+	publicServer, _, stop := setupPool(t, pool, WithTCPTargets(backendAddr), WithProxyProtocol(1))
+	defer stop()
+
+	addr, err := pool.ExposeTCP("d001", "127.0.0.1:0", backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.DialTimeout("tcp", addr.String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the backend sees the address of the client of the public server
+	client := c.LocalAddr().(*net.TCPAddr)
+	backend, err := net.ResolveTCPAddr("tcp", backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", client.IP, backend.IP, client.Port, backend.Port)
+	if line != want {
+		t.Errorf("expected header %q, got %q", want, line)
+	}
+
+	if _, err := NewListener(publicServer.Client(), publicServer.URL, "d002", WithProxyProtocol(3)); err == nil {
+		t.Errorf("expected error on unsupported PROXY protocol version")
+	}
+}
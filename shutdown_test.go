@@ -0,0 +1,158 @@
+package h2rev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serveSlow serves on the Listener a handler that replies with the name
+// after the delay requested on the path
+func serveSlow(l *Listener, name string) *http.Server {
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d, err := time.ParseDuration(r.URL.Query().Get("delay")); err == nil {
+			time.Sleep(d)
+		}
+		fmt.Fprint(w, name)
+	})}
+	go server.Serve(l)
+	return server
+}
+
+func getBody(client *http.Client, uri string) (string, int, error) {
+	resp, err := client.Get(uri)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), resp.StatusCode, err
+}
+
+func TestListenerShutdown(t *testing.T) {
+	pool := NewReversePool()
+	publicServer, l1, stop := setupPool(t, pool)
+	defer stop()
+	defer serveSlow(l1, "l1").Close()
+
+	client := publicServer.Client()
+	uri := publicServer.URL + "/proxy/d001/"
+	// in-flight request
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		body, _, err := getBody(client, uri+"?delay=1s")
+		resc <- result{body, err}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	l2, err := NewListener(publicServer.Client(), publicServer.URL, "d001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	defer serveSlow(l2, "l2").Close()
+	waitHandshake(t, pool, "d001")
+
+	shutdownc := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdownc <- l1.Shutdown(ctx)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// new requests go to the Listener not draining
+	for i := 0; i < 4; i++ {
+		body, _, err := getBody(client, uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "l2" {
+			t.Errorf("expected request served by l2, got %s", body)
+		}
+	}
+
+	res := <-resc
+	if res.err != nil || res.body != "l1" {
+		t.Errorf("in-flight request failed: %q %v", res.body, res.err)
+	}
+	select {
+	case err := <-shutdownc:
+		if err != nil {
+			t.Errorf("unexpected error on Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown did not complete")
+	}
+	if _, err := l1.Accept(); !errors.Is(err, ErrListenerClosed) {
+		t.Errorf("expected Listener closed, got %v", err)
+	}
+
+	// the Listener is closed when the context expires
+	go func() {
+		getBody(client, uri+"?delay=5s")
+	}()
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := l2.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestReversePoolShutdown(t *testing.T) {
+	pool := NewReversePool()
+	publicServer, l, stop := setupPool(t, pool)
+	defer stop()
+	defer serveSlow(l, "l1").Close()
+
+	client := publicServer.Client()
+	uri := publicServer.URL + "/proxy/d001/"
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		body, _, err := getBody(client, uri+"?delay=1s")
+		resc <- result{body, err}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	shutdownc := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdownc <- pool.Shutdown(ctx)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// new requests are rejected
+	if _, code, err := getBody(client, uri); err != nil || code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d %v", http.StatusServiceUnavailable, code, err)
+	}
+
+	res := <-resc
+	if res.err != nil || res.body != "l1" {
+		t.Errorf("in-flight request failed: %q %v", res.body, res.err)
+	}
+	select {
+	case err := <-shutdownc:
+		if err != nil {
+			t.Errorf("unexpected error on Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown did not complete")
+	}
+	if d := pool.GetDialer("d001"); d != nil && !isClosedChan(d.Done()) {
+		t.Errorf("expected dialer closed")
+	}
+}
@@ -0,0 +1,165 @@
+package h2rev2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// time to obtain a reverse connection for an accepted TCP connection
+const tcpDialTimeout = 30 * time.Second
+
+// tcpExposure is a TCP listener on the public host forwarding the connections
+// through the reverse connections of a Dialer.
+type tcpExposure struct {
+	id     string
+	addr   string // requested address
+	target string // host:port on the Listener side
+	ln     net.Listener
+	owner  *Dialer // not nil if requested by the Listener, closed with it
+}
+
+// ExposeTCP listens on the TCP address addr of the public host and forwards the
+// accepted connections through the reverse connections of the id to the target
+// host:port on the Listener side. The Listener has to allow the target.
+// It returns the address the pool is listening on.
+func (rp *ReversePool) ExposeTCP(id string, addr string, target string) (net.Addr, error) {
+	return rp.listenTCP(id, addr, target, nil)
+}
+
+// UnexposeTCP stops listening on the address returned by ExposeTCP.
+func (rp *ReversePool) UnexposeTCP(addr net.Addr) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	e, ok := rp.exposures[addr.String()]
+	if !ok {
+		return fmt.Errorf("address %s not exposed", addr)
+	}
+	delete(rp.exposures, addr.String())
+	return e.ln.Close()
+}
+
+// exposeTCP handles the requests of the Listener of the Dialer d to expose a TCP port.
+func (rp *ReversePool) exposeTCP(d *Dialer, addr string, target string) (net.Addr, error) {
+	if rp.AllowTCPExposure == nil || !rp.AllowTCPExposure(d.id, addr) {
+		return nil, fmt.Errorf("exposing address %s not allowed", addr)
+	}
+	// the Listeners sharing the id request the same exposure, and they request
+	// it again after reconnecting, release the address if it is still held by
+	// a previous dialer
+	rp.mu.Lock()
+	for k, e := range rp.exposures {
+		if e.owner == nil || e.id != d.id || e.addr != addr {
+			continue
+		}
+		if e.owner == d && e.target == target {
+			rp.mu.Unlock()
+			return e.ln.Addr(), nil
+		}
+		e.ln.Close()
+		delete(rp.exposures, k)
+	}
+	rp.mu.Unlock()
+	return rp.listenTCP(d.id, addr, target, d)
+}
+
+func (rp *ReversePool) listenTCP(id string, addr string, target string, owner *Dialer) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e := &tcpExposure{
+		id:     id,
+		addr:   addr,
+		target: target,
+		ln:     ln,
+		owner:  owner,
+	}
+	rp.mu.Lock()
+	if isClosedChan(rp.shutdownc) {
+		rp.mu.Unlock()
+		ln.Close()
+		return nil, fmt.Errorf("reverse pool shutting down")
+	}
+	rp.exposures[ln.Addr().String()] = e
+	rp.mu.Unlock()
+
+	if owner != nil {
+		go func() {
+			<-owner.Done()
+			rp.mu.Lock()
+			if rp.exposures[ln.Addr().String()] == e {
+				delete(rp.exposures, ln.Addr().String())
+			}
+			rp.mu.Unlock()
+			ln.Close()
+		}()
+	}
+	go rp.serveTCP(e)
+	klog.V(2).Infof("exposing %s to %s on id %s", ln.Addr(), target, id)
+	return ln.Addr(), nil
+}
+
+func (rp *ReversePool) serveTCP(e *tcpExposure) {
+	for {
+		c, err := e.ln.Accept()
+		if err != nil {
+			klog.V(5).Infof("stopped exposing %s: %v", e.ln.Addr(), err)
+			return
+		}
+		go rp.forwardTCP(e, c)
+	}
+}
+
+// forwardTCP pipes the accepted connection c through a reverse connection.
+func (rp *ReversePool) forwardTCP(e *tcpExposure, c net.Conn) {
+	defer c.Close()
+	d := rp.GetDialer(e.id)
+	if d == nil {
+		klog.V(2).Infof("no reverse connections for id %s, closing connection from %s", e.id, c.RemoteAddr())
+		return
+	}
+	ctx := ContextWithClient(context.Background(), c.RemoteAddr().String(), "")
+	ctx, cancel := context.WithTimeout(ctx, tcpDialTimeout)
+	rc, err := d.dial(ctx, dialTarget{network: "tcp", address: e.target, forward: e.target})
+	cancel()
+	if err != nil {
+		klog.V(2).Infof("can not forward connection from %s to %s on id %s: %v", c.RemoteAddr(), e.target, e.id, err)
+		return
+	}
+	pipe(c, rc)
+}
+
+// closeWriter is implemented by the connections that support half-close,
+// like *net.TCPConn and the reverse connections.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data between both connections until one of them is closed,
+// then it closes both. If one of them ends its writes, the end is
+// propagated to the other and the copy continues on the other direction.
+func pipe(a, b net.Conn) {
+	halfc := make(chan bool, 2)
+	cp := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			halfc <- cw.CloseWrite() == nil
+			return
+		}
+		halfc <- false
+	}
+	go cp(a, b)
+	go cp(b, a)
+	if !<-halfc {
+		a.Close()
+		b.Close()
+	}
+	<-halfc
+	a.Close()
+	b.Close()
+}
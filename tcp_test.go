@@ -0,0 +1,220 @@
+package h2rev2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer returns the address of a TCP server that echoes the data received
+func echoServer(t *testing.T) (string, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// addrPort returns the port of the address
+func addrPort(t *testing.T, addr string) string {
+	t.Helper()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// waitHandshake waits until all the Listeners of the id complete the
+// handshake and returns their Dialer
+func waitHandshake(t *testing.T, pool *ReversePool, id string) *Dialer {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if d := pool.GetDialer(id); d != nil {
+			d.mu.Lock()
+			done := len(d.sessions) > 0
+			for _, s := range d.sessions {
+				done = done && s.handshake
+			}
+			d.mu.Unlock()
+			if done {
+				return d
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("handshake with the Listeners of %s not completed", id)
+	return nil
+}
+
+func testEcho(t *testing.T, addr string) {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Write([]byte("hello tunnel\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello tunnel\n" {
+		t.Errorf("expected echo, got %q", line)
+	}
+}
+
+func TestExposeTCP(t *testing.T) {
+	echoAddr, stopEcho := echoServer(t)
+	defer stopEcho()
+
+	pool := NewReversePool()
+	_, _, stop := setupPool(t, pool, WithTCPTargets(echoAddr))
+	defer stop()
+
+	addr, err := pool.ExposeTCP("d001", "127.0.0.1:0", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, addr.String())
+
+	// targets not allowed by the Listener are rejected
+	denied, err := pool.ExposeTCP("d001", "127.0.0.1:0", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", denied.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected connection closed, got %v", err)
+	}
+	c.Close()
+
+	if err := pool.UnexposeTCP(addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.DialTimeout("tcp", addr.String(), time.Second); err == nil {
+		t.Errorf("expected address %s not to be exposed", addr)
+	}
+}
+
+func TestListenerTCPExposure(t *testing.T) {
+	echoAddr, stopEcho := echoServer(t)
+	defer stopEcho()
+
+	pool := NewReversePool()
+	publicAddr := freePort(t)
+	pool.AllowTCPExposure = func(id string, addr string) bool {
+		return id == "d001" && addr == publicAddr
+	}
+	_, l, stop := setupPool(t, pool, WithTCPExposure(publicAddr, echoAddr))
+	defer stop()
+
+	var exposed bool
+	for i := 0; i < 10 && !exposed; i++ {
+		pool.mu.Lock()
+		_, exposed = pool.exposures[publicAddr]
+		pool.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !exposed {
+		t.Fatalf("address %s not exposed", publicAddr)
+	}
+	testEcho(t, publicAddr)
+
+	// the exposure is released with the control connection
+	l.Close()
+	for i := 0; i < 10 && exposed; i++ {
+		pool.mu.Lock()
+		_, exposed = pool.exposures[publicAddr]
+		pool.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+	if exposed {
+		t.Errorf("address %s still exposed", publicAddr)
+	}
+}
+
+func TestExposeTCPHalfClose(t *testing.T) {
+	// the server replies once the client ends its writes
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b, _ := ioutil.ReadAll(c)
+				fmt.Fprintf(c, "received %d bytes", len(b))
+			}()
+		}
+	}()
+
+	pool := NewReversePool()
+	_, _, stop := setupPool(t, pool, WithTCPTargets(target.Addr().String()))
+	defer stop()
+
+	addr, err := pool.ExposeTCP("d001", "127.0.0.1:0", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.DialTimeout("tcp", addr.String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Write(make([]byte, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "received 100000 bytes" {
+		t.Errorf("unexpected reply %q", got)
+	}
+}
@@ -0,0 +1,192 @@
+package h2rev2
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// trailer of the responses of the data connections with the reason the
+	// connection was closed, so the Listener knows why
+	headerCloseReason = "X-H2rev2-Close-Reason"
+	// header of the responses of the data connections with the id the
+	// Listener uses to ask the pool to close the connection
+	headerConnID = "X-H2rev2-Conn-Id"
+)
+
+// WithConnIdleTimeout closes the data connections of the Listener that do
+// not read or write any data during the timeout.
+func WithConnIdleTimeout(timeout time.Duration) ListenerOption {
+	return func(ln *Listener) {
+		ln.connIdleTimeout = timeout
+	}
+}
+
+// WithConnMaxLifetime closes the data connections of the Listener once they
+// are open for the lifetime.
+func WithConnMaxLifetime(lifetime time.Duration) ListenerOption {
+	return func(ln *Listener) {
+		ln.connMaxLifetime = lifetime
+	}
+}
+
+// CloseReason returns the reason a connection created through the reverse
+// connections was closed, by this side or by the peer, per example
+// ReasonIdleTimeout. It returns false if the connection is open or it was
+// not created by this package.
+func CloseReason(c net.Conn) (string, bool) {
+	cc, ok := c.(*conn)
+	if !ok || !isClosedChan(cc.done) {
+		return "", false
+	}
+	return cc.closeReason(), true
+}
+
+// setTimeouts closes the connection with ReasonIdleTimeout if it does not
+// read or write data during the idle timeout, and with ReasonMaxLifetime
+// once the lifetime expires. The zero values disable them.
+func (c *conn) setTimeouts(idle, lifetime time.Duration) {
+	c.timerMu.Lock()
+	defer c.timerMu.Unlock()
+	if c.timersDone {
+		return
+	}
+	if idle > 0 {
+		c.idleTimeout = idle
+		c.active()
+		c.idleTimer = time.AfterFunc(idle, c.checkIdle)
+	}
+	if lifetime > 0 {
+		c.lifeTimer = time.AfterFunc(lifetime, func() {
+			c.closeWithReason(ReasonMaxLifetime)
+		})
+	}
+}
+
+// active records the activity of the connection for the idle timeout.
+func (c *conn) active() {
+	if c.idleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+}
+
+func (c *conn) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+	if idle >= c.idleTimeout {
+		c.closeWithReason(ReasonIdleTimeout)
+		return
+	}
+	c.timerMu.Lock()
+	defer c.timerMu.Unlock()
+	if !c.timersDone {
+		c.idleTimer.Reset(c.idleTimeout - idle)
+	}
+}
+
+func (c *conn) stopTimers() {
+	c.timerMu.Lock()
+	defer c.timerMu.Unlock()
+	c.timersDone = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	if c.lifeTimer != nil {
+		c.lifeTimer.Stop()
+	}
+}
+
+// setReason sets the reason the connection is closed if it is not set.
+func (c *conn) setReason(reason string) {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+}
+
+func (c *conn) closeReason() string {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	if c.reason == "" {
+		return ReasonClosed
+	}
+	return c.reason
+}
+
+// closeWithReason closes the connection telling the peer the reason.
+// The requests can not carry the reason safely, the trailers of a stream
+// already closed by the server break the whole HTTP/2 connection, so the
+// Listener asks the pool to close the connection with the reason and waits
+// for it before closing it anyway.
+func (c *conn) closeWithReason(reason string) {
+	c.setReason(reason)
+	if c.closePeer != nil && c.closePeer(reason) {
+		t := time.NewTimer(closePeerTimeout)
+		select {
+		case <-c.done:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+	c.Close()
+}
+
+// responseReason sends the close reason on the trailers of the response w.
+func (c *conn) responseReason(w http.ResponseWriter) {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	c.sendReason = func(reason string) {
+		c.headerMu.Lock()
+		defer c.headerMu.Unlock()
+		w.Header().Set(http.TrailerPrefix+headerCloseReason, reason)
+	}
+}
+
+// sendHeaders sends the response headers of w, set by setHeader if not nil.
+// The connection can be closed meanwhile, the close reason is not set on the
+// headers until they are sent.
+func (c *conn) sendHeaders(w http.ResponseWriter, setHeader func(http.Header)) {
+	c.headerMu.Lock()
+	defer c.headerMu.Unlock()
+	if setHeader != nil {
+		setHeader(w.Header())
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// trailerReason receives the close reason of the peer from the trailers of
+// the response res.
+func (c *conn) trailerReason(res *http.Response) {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	c.peerReason = func() string {
+		return res.Trailer.Get(headerCloseReason)
+	}
+}
+
+// sendCloseReason sends the close reason to the peer, if it can be sent.
+func (c *conn) sendCloseReason() {
+	c.peerMu.Lock()
+	sendReason := c.sendReason
+	c.peerMu.Unlock()
+	if sendReason != nil {
+		sendReason(c.closeReason())
+	}
+}
+
+// receiveReason sets the close reason sent by the peer, if any.
+func (c *conn) receiveReason() {
+	c.peerMu.Lock()
+	peerReason := c.peerReason
+	c.peerMu.Unlock()
+	if peerReason == nil {
+		return
+	}
+	if reason := peerReason(); reason != "" {
+		c.setReason(reason)
+	}
+}
@@ -0,0 +1,166 @@
+package h2rev2
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// connPair sets up the pool and returns a connection dialed from it and the one
+// accepted by the Listener d001
+func connPair(t *testing.T, pool *ReversePool, opts ...ListenerOption) (net.Conn, net.Conn, func()) {
+	t.Helper()
+	_, l, stop := setupPool(t, pool, opts...)
+	acceptc := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			acceptc <- c
+		}
+	}()
+	c1, err := pool.GetDialer("d001").Dial(context.Background(), "tcp", "d001:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c2 net.Conn
+	select {
+	case c2 = <-acceptc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted")
+	}
+	return c1, c2, func() {
+		c1.Close()
+		c2.Close()
+		stop()
+	}
+}
+
+// waitClosed waits until the connection is closed and returns the reason
+func waitClosed(t *testing.T, c net.Conn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, err := c.Read(make([]byte, 64))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected connection closed, got %v", err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if reason, ok := CloseReason(c); ok {
+			return reason
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("connection not closed")
+	return ""
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	pool := NewReversePool()
+	pool.ConnIdleTimeout = 500 * time.Millisecond
+	closedc := make(chan ConnEvent, 1)
+	pool.Hooks.OnConnClosed = func(e ConnEvent) { closedc <- e }
+	c1, c2, stop := connPair(t, pool)
+	defer stop()
+
+	// the connection is kept open while there is activity
+	start := time.Now()
+	for time.Since(start) < 1500*time.Millisecond {
+		if _, err := c1.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c2, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if _, ok := CloseReason(c1); ok {
+		t.Fatal("active connection closed")
+	}
+
+	// both sides know why the connection was closed
+	if reason := waitClosed(t, c1); reason != ReasonIdleTimeout {
+		t.Errorf("expected reason %q on the pool, got %q", ReasonIdleTimeout, reason)
+	}
+	if reason := waitClosed(t, c2); reason != ReasonIdleTimeout {
+		t.Errorf("expected reason %q on the Listener, got %q", ReasonIdleTimeout, reason)
+	}
+	select {
+	case e := <-closedc:
+		if e.Reason != ReasonIdleTimeout {
+			t.Errorf("expected closed event with reason %q, got %q", ReasonIdleTimeout, e.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("connection closed event not received")
+	}
+}
+
+func TestConnMaxLifetime(t *testing.T) {
+	pool := NewReversePool()
+	c1, c2, stop := connPair(t, pool, WithConnMaxLifetime(time.Second))
+	defer stop()
+
+	// the activity does not extend the lifetime
+	go func() {
+		for {
+			if _, err := c1.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	if reason := waitClosed(t, c2); reason != ReasonMaxLifetime {
+		t.Errorf("expected reason %q on the Listener, got %q", ReasonMaxLifetime, reason)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("connection closed after %v", d)
+	}
+	if reason := waitClosed(t, c1); reason != ReasonMaxLifetime {
+		t.Errorf("expected reason %q on the pool, got %q", ReasonMaxLifetime, reason)
+	}
+}
+
+func TestConnCloseReason(t *testing.T) {
+	pool := NewReversePool()
+	c1, c2, stop := connPair(t, pool)
+	defer stop()
+
+	if _, ok := CloseReason(c2); ok {
+		t.Fatal("expected open connection")
+	}
+	c2.Close()
+	if reason := waitClosed(t, c1); reason != ReasonClosed {
+		t.Errorf("expected reason %q, got %q", ReasonClosed, reason)
+	}
+	if _, ok := CloseReason(&net.TCPConn{}); ok {
+		t.Error("expected no reason for connections of other packages")
+	}
+}
+
+func TestConnTimeoutsAfterClose(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	c := newConn(pr, nopWriteCloser{ioutil.Discard})
+	// the peer closes the connection while the timeouts are set
+	donec := make(chan struct{})
+	go func() {
+		c.Close()
+		close(donec)
+	}()
+	c.setTimeouts(time.Hour, time.Hour)
+	<-donec
+	c.timerMu.Lock()
+	defer c.timerMu.Unlock()
+	for _, timer := range []*time.Timer{c.idleTimer, c.lifeTimer} {
+		if timer != nil && timer.Stop() {
+			t.Errorf("timer armed on a closed connection")
+		}
+	}
+}
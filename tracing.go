@@ -0,0 +1,68 @@
+package h2rev2
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/aojea/h2rev2"
+
+// names of the spans
+const (
+	spanProxy        = "h2rev2.proxy"         // request proxied by the ReversePool
+	spanDial         = "h2rev2.dial"          // wait for the Listener to pick up a connection
+	spanConn         = "h2rev2.conn"          // data connection lifetime on the ReversePool
+	spanListenerConn = "h2rev2.listener.conn" // data connection lifetime on the Listener
+)
+
+// attributes of the spans
+const (
+	attrID      = attribute.Key("h2rev2.id")
+	attrNetwork = attribute.Key("h2rev2.network")
+	attrAddress = attribute.Key("h2rev2.address")
+	attrForward = attribute.Key("h2rev2.forward")
+	attrIdle    = attribute.Key("h2rev2.idle")
+)
+
+// the trace context is propagated with the W3C headers
+var propagator = propagation.TraceContext{}
+
+// newTracer returns the tracer of the provider, the spans are not recorded
+// if the provider is nil.
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// injectTrace returns the W3C headers with the trace context of ctx.
+func injectTrace(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTrace returns a context with the trace context of the W3C headers.
+func extractTrace(ctx context.Context, headers map[string]string) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
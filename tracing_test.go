@@ -0,0 +1,101 @@
+package h2rev2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	for _, idle := range []int{0, 1} {
+		t.Run(fmt.Sprintf("idle connections %d", idle), func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			defer tp.Shutdown(context.Background())
+
+			pool := NewReversePool()
+			pool.TracerProvider = tp
+			publicServer, l, stop := setupPool(t, pool, WithTracerProvider(tp), WithIdleConns(idle))
+			defer stop()
+			// the backend gets the trace context on the request and on the connection
+			connTraces := make(chan trace.SpanContext, 1)
+			reqTraces := make(chan trace.SpanContext, 1)
+			server := &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ctx := extractTrace(r.Context(), map[string]string{"traceparent": r.Header.Get("traceparent")})
+					reqTraces <- trace.SpanContextFromContext(ctx)
+					fmt.Fprint(w, "hello")
+				}),
+				ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+					meta, _ := MetadataFromConn(c)
+					connTraces <- trace.SpanContextFromContext(meta.Context(ctx))
+					return ctx
+				},
+			}
+			go server.Serve(l)
+			defer server.Close()
+			// wait for the idle connection to be parked
+			time.Sleep(200 * time.Millisecond)
+
+			// the client starts the trace
+			ctx, parent := tp.Tracer("client").Start(context.Background(), "client")
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, publicServer.URL+"/proxy/d001/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+			resp, err := publicServer.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			parent.End()
+			traceID := parent.SpanContext().TraceID()
+
+			spans := map[string]sdktrace.ReadOnlySpan{}
+			for i := 0; i < 50 && len(spans) < 5; i++ {
+				for _, s := range exporter.GetSpans().Snapshots() {
+					spans[s.Name()] = s
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			for _, name := range []string{spanProxy, spanDial, spanConn, spanListenerConn} {
+				s, ok := spans[name]
+				if !ok {
+					t.Fatalf("span %s not found, got %v", name, spans)
+				}
+				if s.SpanContext().TraceID() != traceID {
+					t.Errorf("span %s not part of the trace %s", name, traceID)
+				}
+			}
+			if spans[spanProxy].Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("expected proxy span child of the client span")
+			}
+			if spans[spanDial].Parent().SpanID() != spans[spanProxy].SpanContext().SpanID() {
+				t.Errorf("expected dial span child of the proxy span")
+			}
+			if spans[spanConn].Parent().SpanID() != spans[spanProxy].SpanContext().SpanID() {
+				t.Errorf("expected conn span child of the proxy span")
+			}
+			listenerSpan := spans[spanListenerConn]
+			if listenerSpan.Parent().SpanID() != spans[spanDial].SpanContext().SpanID() || !listenerSpan.Parent().IsRemote() {
+				t.Errorf("expected listener conn span child of the dial span")
+			}
+
+			if sc := <-connTraces; sc.SpanID() != listenerSpan.SpanContext().SpanID() {
+				t.Errorf("expected connection metadata with the listener conn span, got %v", sc)
+			}
+			if sc := <-reqTraces; sc.TraceID() != traceID {
+				t.Errorf("expected request with the trace %s, got %v", traceID, sc)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package h2rev2
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/propagation"
+	"k8s.io/klog/v2"
+)
+
+// GUID used to compute the Sec-WebSocket-Accept header (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// isExtendedConnect returns true if the request is an HTTP/2 extended
+// CONNECT (RFC 8441), used to bootstrap WebSockets and other protocols over
+// an HTTP/2 stream.
+//
+// The Go HTTP/2 server only accepts them if it runs with the environment
+// variable GODEBUG=http2xconnect=1.
+func isExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.Header.Get(":protocol") != ""
+}
+
+// serveExtendedConnect bridges an HTTP/2 extended CONNECT request onto a
+// reverse connection: the backend receives the equivalent HTTP/1.1 Upgrade
+// request and, once it switches protocols, the stream is piped to the raw
+// connection. The HTTP/1.1 Upgrade requests are handled by the reverse proxy.
+// The Host header of the request to the backend is host.
+func (rp *ReversePool) serveExtendedConnect(w http.ResponseWriter, r *http.Request, d *Dialer, host string) error {
+	protocol := r.Header.Get(":protocol")
+	c, err := d.Dial(r.Context(), "tcp", net.JoinHostPort(d.id, "80"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	defer c.Close()
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     r.Header.Clone(),
+		Host:       host,
+	}
+	req.Header.Del(":protocol")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	// RFC 8441 removes the key, the backend speaking HTTP/1.1 requires it
+	key := ""
+	isWebsocket := strings.EqualFold(protocol, "websocket")
+	if isWebsocket {
+		key, err = websocketKey()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+		req.Header.Set("Sec-WebSocket-Key", key)
+		if req.Header.Get("Sec-WebSocket-Version") == "" {
+			req.Header.Set("Sec-WebSocket-Version", "13")
+		}
+	}
+	// the backend continues the trace
+	propagator.Inject(r.Context(), propagation.HeaderCarrier(req.Header))
+	if err := req.Write(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the backend rejected the upgrade, relay its response
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return nil
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), protocol) {
+		err := fmt.Errorf("backend switched to protocol %q, requested %q", resp.Header.Get("Upgrade"), protocol)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	if isWebsocket && resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		err := fmt.Errorf("backend replied with a wrong Sec-WebSocket-Accept")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	copyHeader(w.Header(), resp.Header)
+	for _, h := range []string{"Connection", "Upgrade", "Sec-WebSocket-Accept"} {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	klog.V(5).Infof("extended CONNECT to id %s upgraded to %s", d.id, protocol)
+
+	// the reader contains the bytes buffered after the response
+	return pipeStream(w, r, c, br)
+}
+
+// pipeStream copies data between the HTTP/2 stream of the request and the
+// connection c until one of them is closed, reading the data of c from src.
+// If the client ends the request, the writes of c are ended and the response
+// is copied until c ends.
+func pipeStream(w http.ResponseWriter, r *http.Request, c net.Conn, src io.Reader) error {
+	errc := make(chan error, 2)
+	halfc := make(chan struct{})
+	go func() {
+		_, err := io.Copy(c, r.Body)
+		// the client ended the request, end the writes and keep copying the
+		// response
+		if cw, ok := c.(closeWriter); ok && err == nil && cw.CloseWrite() == nil {
+			close(halfc)
+			return
+		}
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(flushWriter{w}, src)
+		errc <- err
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-halfc:
+		return <-errc
+	}
+	// unblock the other direction, the handler can not return while it
+	// writes to the response
+	c.Close()
+	r.Body.Close()
+	select {
+	case <-errc:
+	case <-halfc:
+	}
+	return err
+}
+
+// websocketKey returns a random Sec-WebSocket-Key.
+func websocketKey() (string, error) {
+	p := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(p), nil
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept expected for the key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
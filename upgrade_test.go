@@ -0,0 +1,274 @@
+package h2rev2
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"golang.org/x/net/websocket"
+)
+
+// serveWebSocket serves a WebSocket echo server on the Listener
+func serveWebSocket(l net.Listener) func() {
+	server := &http.Server{Handler: websocket.Server{Handler: func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}}}
+	go server.Serve(l)
+	return func() { server.Close() }
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	publicServer, l, stop := setupPool(t, NewReversePool())
+	defer stop()
+	defer serveWebSocket(l)()
+
+	config, err := websocket.NewConfig(strings.Replace(publicServer.URL, "https://", "wss://", 1)+"/proxy/d001/echo", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HTTP/1.1 only, the Upgrade mechanism does not exist in HTTP/2
+	config.TlsConfig = publicServer.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.TlsConfig.NextProtos = nil
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != msg {
+			t.Fatalf("expected %q, got %q", msg, reply)
+		}
+	}
+}
+
+func TestWebSocketExtendedConnect(t *testing.T) {
+	// the HTTP/2 server and transport only support the extended CONNECT
+	// if it is enabled on the environment before the process starts
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWebSocketExtendedConnect$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("extended CONNECT test failed: %v\n%s", err, out)
+		}
+		if bytes.Contains(out, []byte("--- SKIP")) {
+			t.Skipf("extended CONNECT not supported:\n%s", out)
+		}
+		return
+	}
+
+	publicServer, l, stop := setupPool(t, NewReversePool())
+	defer stop()
+	defer serveWebSocket(l)()
+
+	stream, err := dialExtendedConnect(publicServer, "/proxy/d001/echo", "websocket")
+	if errors.Is(err, errExtendedConnectDisabled) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		if err := writeWebSocketFrame(stream, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := readWebSocketFrame(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != msg {
+			t.Fatalf("expected %q, got %q", msg, reply)
+		}
+	}
+}
+
+// writeWebSocketFrame writes a small masked text frame, as a client does.
+func writeWebSocketFrame(w io.Writer, payload []byte) error {
+	if len(payload) > 125 {
+		return errors.New("payload too large")
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readWebSocketFrame reads an unmasked frame, as a server sends it.
+func readWebSocketFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[1]&0x80 != 0 {
+		return nil, errors.New("unexpected masked frame")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var l uint16
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return nil, err
+		}
+		length = uint64(l)
+	case 127:
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return payload, err
+}
+
+var errExtendedConnectDisabled = errors.New("server does not support the extended CONNECT")
+
+// h2Stream is an extended CONNECT stream over a raw HTTP/2 connection, the
+// net/http client does not allow to send the :protocol pseudo header.
+type h2Stream struct {
+	conn   net.Conn
+	framer *http2.Framer
+	mu     sync.Mutex // serializes the writes on the framer
+	pr     *io.PipeReader
+}
+
+// dialExtendedConnect opens an extended CONNECT stream to the path of the
+// server, it returns once the server replies with a 200 response.
+func dialExtendedConnect(server *httptest.Server, path, protocol string) (*h2Stream, error) {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		return nil, err
+	}
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.NextProtos = []string{http2.NextProtoTLS}
+	conn, err := tls.Dial("tcp", u.Host, config)
+	if err != nil {
+		return nil, err
+	}
+	s := &h2Stream{conn: conn, framer: http2.NewFramer(conn, conn)}
+	s.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := s.framer.WriteSettings(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the server announces SETTINGS_ENABLE_CONNECT_PROTOCOL on its first frame
+	f, err := s.framer.ReadFrame()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	settings, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected frame %v", f)
+	}
+	if v, ok := settings.Value(http2.SettingID(0x8)); !ok || v != 1 {
+		conn.Close()
+		return nil, errExtendedConnectDisabled
+	}
+	if err := s.framer.WriteSettingsAck(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for _, hf := range [][2]string{
+		{":method", http.MethodConnect},
+		{":protocol", protocol},
+		{":scheme", "https"},
+		{":authority", u.Host},
+		{":path", path},
+		{"sec-websocket-version", "13"},
+	} {
+		enc.WriteField(hpack.HeaderField{Name: hf[0], Value: hf[1]})
+	}
+	if err := s.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: buf.Bytes(), EndHeaders: true}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	status := make(chan string, 1)
+	pr, pw := io.Pipe()
+	s.pr = pr
+	go func() {
+		for {
+			f, err := s.framer.ReadFrame()
+			if err != nil {
+				pw.CloseWithError(err)
+				close(status)
+				return
+			}
+			switch f := f.(type) {
+			case *http2.MetaHeadersFrame:
+				status <- f.PseudoValue("status")
+			case *http2.DataFrame:
+				pw.Write(f.Data())
+				if f.StreamEnded() {
+					pw.Close()
+				}
+			case *http2.RSTStreamFrame:
+				pw.CloseWithError(fmt.Errorf("stream reset: %v", f.ErrCode))
+			case *http2.SettingsFrame:
+				if !f.IsAck() {
+					s.mu.Lock()
+					s.framer.WriteSettingsAck()
+					s.mu.Unlock()
+				}
+			}
+		}
+	}()
+	if code := <-status; code != "200" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected status %q", code)
+	}
+	return s, nil
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.pr.Read(p)
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.framer.WriteData(1, false, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *h2Stream) Close() error {
+	return s.conn.Close()
+}